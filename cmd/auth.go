@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/lazy"
+)
+
+func newAuthCmd(cfg *config.Config) *cobra.Command {
+	result := &cobra.Command{
+		Use:   "auth",
+		Short: "Manage the Last.FM session used to scrobble tracks",
+	}
+
+	result.AddCommand(newAuthLoginCmd(cfg))
+	result.AddCommand(newAuthLogoutCmd(cfg))
+	result.AddCommand(newAuthStatusCmd(cfg))
+
+	return result
+}
+
+func newAuthLoginCmd(cfg *config.Config) *cobra.Command {
+	var (
+		interval time.Duration
+		timeout  time.Duration
+	)
+
+	result := &cobra.Command{
+		Use:   "login",
+		Short: "Log in to Last.FM by approving pianoman in your browser",
+		Long: "Log in to Last.FM using the desktop authentication flow. pianoman prints a URL to visit to approve " +
+			"access to your account, and waits until access is approved. The resulting session is cached, so your " +
+			"password does not need to be stored in the config file.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			opts, err := lastfmOptions(*cfg)
+			if err != nil {
+				return err
+			}
+
+			// Use a fresh session cache, we don't want to touch the existing session until we have a new one
+			lfm := lastfm.New(lazy.New[string](func() {}), cfg.Auth.API.Key, cfg.Auth.API.Secret, "", "", opts...)
+
+			token, err := lfm.GetToken(ctx)
+			if err != nil {
+				return err
+			}
+
+			_, _ = fmt.Fprintf(
+				cmd.OutOrStdout(),
+				"Visit the following URL to allow pianoman to access your Last.FM account:\n\n\t%s\n\n",
+				lfm.AuthURL(token),
+			)
+
+			logrus.Info("Waiting for access to be approved")
+			session, err := lfm.WaitForSession(ctx, token, interval)
+			if err != nil {
+				return err
+			}
+
+			if err = writeSession(*cfg, session.Key); err != nil {
+				return fmt.Errorf("failed to cache session: %w", err)
+			}
+
+			logrus.Infof("Logged in to Last.FM as %s", session.Name)
+			return nil
+		},
+	}
+
+	result.Flags().DurationVar(&interval, "interval", 5*time.Second, "How often to check if access has been approved")
+	result.Flags().DurationVar(&timeout, "timeout", 5*time.Minute, "How long to wait for access to be approved")
+
+	return result
+}
+
+func newAuthLogoutCmd(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "logout",
+		Short: "Delete the cached Last.FM session",
+		Long: "Delete the cached Last.FM session. If a password is configured, pianoman will log in again the next " +
+			"time it needs to contact Last.FM. Otherwise, you will need to run 'pianoman auth login' again.",
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			err := removeSession(*cfg)
+			if errors.Is(err, fs.ErrNotExist) {
+				logrus.Info("Not logged in")
+				return nil
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to delete session: %w", err)
+			}
+
+			logrus.Info("Deleted cached session")
+			return nil
+		},
+	}
+}
+
+func newAuthStatusCmd(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the cached Last.FM session",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			out := cmd.OutOrStdout()
+
+			_, _ = fmt.Fprintf(out, "Session File: %s\n", sessionPath(*cfg))
+
+			key, err := readSession(cmd.Context(), *cfg)
+			switch {
+			case errors.Is(err, fs.ErrNotExist) || key == "":
+				_, _ = fmt.Fprintln(out, "Session: none")
+			case err != nil:
+				return fmt.Errorf("failed to read session: %w", err)
+			default:
+				_, _ = fmt.Fprintf(out, "Session: %s\n", maskSecret(key))
+				if info, err := os.Stat(sessionPath(*cfg)); err == nil {
+					_, _ = fmt.Fprintf(out, "Cached At: %s\n", info.ModTime().Format(time.RFC3339))
+				}
+			}
+
+			if cfg.Auth.User.Password != "" {
+				_, _ = fmt.Fprintf(out, "Password Login: configured for %s\n", cfg.Auth.User.Name)
+			} else {
+				_, _ = fmt.Fprintln(out, "Password Login: not configured")
+			}
+
+			return nil
+		},
+	}
+}
+
+// maskSecret hides all but the first and last few characters of v
+func maskSecret(v string) string {
+	if len(v) <= 8 {
+		return "********"
+	}
+
+	return v[:4] + "..." + v[len(v)-4:]
+}
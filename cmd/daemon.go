@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/internal/daemon"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/pianobar/eventcmd"
+)
+
+func newDaemonCmd(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "daemon",
+		Short: "Handle events forwarded by pianoman eventcmd invocations",
+		Long: "Run pianoman in the foreground, handling events forwarded by pianoman eventcmd invocations over a " +
+			"Unix socket. The daemon keeps the WAL open and periodically retries scrobbling any backlog.",
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			b, err := openBacklog(*cfg)
+			if err != nil {
+				return err
+			}
+
+			l, err := daemon.Listen(cfg.Resolve(cfg.Daemon.Socket))
+			if err != nil {
+				return err
+			}
+
+			// Build the Last.FM client once, so the session is reused across events. The session is cached every time
+			// the client is used, since the daemon may be killed at any time.
+			lfm, saveSession, err := newGuardedLastFM(ctx, *cfg)
+			if err != nil {
+				return err
+			}
+
+			// The WAL and the Last.FM client are not safe for concurrent use, so only one event may be handled at a time
+			var mu sync.Mutex
+			flags := handleFlags(*cfg)
+
+			go func() {
+				if cfg.Daemon.RetryInterval <= 0 {
+					logrus.Debug("Not retrying scrobbles in the background")
+					return
+				}
+
+				t := time.NewTicker(cfg.Daemon.RetryInterval)
+				defer t.Stop()
+
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-t.C:
+					}
+
+					mu.Lock()
+					retryBacklog(ctx, *cfg, b, lfm)
+					saveSession()
+					mu.Unlock()
+				}
+			}()
+
+			return daemon.Serve(ctx, l, func(ctx context.Context, event string, payload io.Reader) error {
+				mu.Lock()
+				defer mu.Unlock()
+				defer saveSession()
+
+				ctx, cancel := withBudget(ctx, *cfg)
+				defer cancel()
+
+				_, err := eventcmd.Handle(ctx, event, flags, payload, b, lfm, lfm)
+				return err
+			})
+		},
+	}
+}
+
+// retryBacklog sends any queued requests and tries to scrobble the backlog, within the time allowed for handling an
+// event so events forwarded in the meantime don't wait too long
+func retryBacklog(ctx context.Context, cfg config.Config, b eventcmd.Backlog, lfm *lastfm.Guarded) {
+	ctx, cancel := withBudget(ctx, cfg)
+	defer cancel()
+
+	if err := eventcmd.Drain(ctx, b, lfm, lfm); err != nil {
+		logrus.WithError(err).Warn("Failed to send queued requests")
+	}
+
+	if b.WAL.Empty() {
+		return
+	}
+
+	if err := eventcmd.Flush(ctx, b, lfm); err != nil {
+		logrus.WithError(err).Warn("Failed to scrobble backlog")
+	}
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/pianobar/eventcmd"
+)
+
+func newDeadLettersCmd(cfg *config.Config) *cobra.Command {
+	result := &cobra.Command{
+		Use:     "deadletters",
+		Aliases: []string{"dl"},
+		Short:   "Inspect and manage tracks Last.FM refused to scrobble",
+		Long: "Inspect and manage tracks that caused Last.FM to fail a scrobble request with an error that should " +
+			"not be retried. Dead letters are never scrobbled unless they are requeued.",
+	}
+
+	result.AddCommand(newDeadLettersListCmd(cfg))
+	result.AddCommand(newDeadLettersRequeueCmd(cfg))
+	result.AddCommand(newDeadLettersPurgeCmd(cfg))
+
+	return result
+}
+
+func newDeadLettersListCmd(cfg *config.Config) *cobra.Command {
+	var output string
+
+	result := &cobra.Command{
+		Use:   "list",
+		Short: "List dead letters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			j, err := openDeadLetters(*cfg)
+			if err != nil {
+				return err
+			}
+
+			deadLetters, err := j.Records()
+			if err != nil {
+				return err
+			}
+
+			return writeOutput(cmd.OutOrStdout(), output, deadLetters, func(tw io.Writer) {
+				_, _ = fmt.Fprintln(tw, "INDEX\tFAILED AT\tARTIST\tTITLE\tALBUM\tATTEMPTS\tERROR")
+				for i, d := range deadLetters {
+					_, _ = fmt.Fprintf(
+						tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d: %s\n",
+						i, d.FailedAt.Local().Format(time.DateTime), d.Track.Artist, d.Track.Title, d.Track.Album,
+						d.Attempts, d.Code, d.Message,
+					)
+				}
+			})
+		},
+	}
+
+	addOutputFlag(result, &output)
+	return result
+}
+
+func newDeadLettersRequeueCmd(cfg *config.Config) *cobra.Command {
+	var artist, title, album string
+
+	result := &cobra.Command{
+		Use:   "requeue <index>...",
+		Short: "Move dead letters back to the WAL to be scrobbled",
+		Long: "Move dead letters back to the WAL to be scrobbled. Dead letters are specified by their index from " +
+			"'deadletters list'. When requeueing a single dead letter, its artist, title, or album may be corrected " +
+			"first.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			edit := cmd.Flags().Changed("artist") || cmd.Flags().Changed("title") || cmd.Flags().Changed("album")
+			if edit && len(args) > 1 {
+				return errors.New("--artist, --title, and --album may only be used when requeueing a single dead letter")
+			}
+
+			indices, err := parseIndices(args)
+			if err != nil {
+				return err
+			}
+
+			b, err := openBacklog(*cfg)
+			if err != nil {
+				return err
+			}
+
+			// Hold the dead letters while requeueing, so concurrent changes don't shift the indices, and only remove the
+			// ones that actually made it back to the WAL
+			return b.DeadLetters.Process(func(deadLetters []eventcmd.DeadLetter) ([]int, error) {
+				for _, i := range indices {
+					if i < 0 || i >= len(deadLetters) {
+						return nil, fmt.Errorf("no such dead letter: %d", i)
+					}
+				}
+
+				requeued := make([]int, 0, len(indices))
+				for _, i := range indices {
+					t := deadLetters[i].Track
+					if cmd.Flags().Changed("artist") {
+						t.Artist = artist
+					}
+
+					if cmd.Flags().Changed("title") {
+						t.Title = title
+					}
+
+					if cmd.Flags().Changed("album") {
+						t.Album = album
+					}
+
+					if err := t.Validate(); err != nil {
+						return requeued, fmt.Errorf("failed to requeue dead letter %d: %w", i, err)
+					}
+
+					if err := b.WAL.Append(t); err != nil {
+						return requeued, fmt.Errorf("failed to requeue dead letter %d: %w", i, err)
+					}
+
+					logrus.Infof("Requeued %s - %s", t.Artist, t.Title)
+					requeued = append(requeued, i)
+				}
+
+				return requeued, nil
+			})
+		},
+	}
+
+	result.Flags().StringVar(&artist, "artist", "", "Correct the artist before requeueing")
+	result.Flags().StringVar(&title, "title", "", "Correct the title before requeueing")
+	result.Flags().StringVar(&album, "album", "", "Correct the album before requeueing")
+
+	return result
+}
+
+func newDeadLettersPurgeCmd(cfg *config.Config) *cobra.Command {
+	var all bool
+
+	result := &cobra.Command{
+		Use:   "purge [index]...",
+		Short: "Permanently remove dead letters",
+		Long: "Permanently remove dead letters, specified by their index from 'deadletters list'. Purged tracks are " +
+			"never scrobbled.",
+		RunE: func(_ *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return errors.New("specify the dead letters to purge, or --all")
+			}
+
+			j, err := openDeadLetters(*cfg)
+			if err != nil {
+				return err
+			}
+
+			if all {
+				n, err := j.Clear()
+				if err != nil {
+					return err
+				}
+
+				logrus.Infof("Purged %d dead letter(s)", n)
+				return nil
+			}
+
+			indices, err := parseIndices(args)
+			if err != nil {
+				return err
+			}
+
+			purged, err := j.Remove(indices...)
+			if err != nil {
+				return err
+			}
+
+			for _, d := range purged {
+				logrus.Infof("Purged %s - %s", d.Track.Artist, d.Track.Title)
+			}
+
+			return nil
+		},
+	}
+
+	result.Flags().BoolVar(&all, "all", false, "Purge all dead letters")
+
+	return result
+}
+
+// parseIndices parses each argument as an index, returning the unique indices in order
+func parseIndices(args []string) ([]int, error) {
+	result := make([]int, 0, len(args))
+	for _, arg := range args {
+		i, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %s: %w", arg, err)
+		}
+
+		result = append(result, i)
+	}
+
+	slices.Sort(result)
+	return slices.Compact(result), nil
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/pianobar/eventcmd"
+	"github.com/nlowe/pianoman/wal"
+)
+
+func TestDeadLettersCmd(t *testing.T) {
+	setup := func(t *testing.T) config.Config {
+		t.Helper()
+
+		cfg := testConfig(t)
+
+		j, err := openDeadLetters(cfg)
+		require.NoError(t, err)
+
+		for _, title := range []string{"First", "Second", "Third"} {
+			require.NoError(t, j.Append(eventcmd.DeadLetter{
+				Track:    pianobar.Track{Artist: "Test Artist", Title: title, ScrobbleAt: time.Now()},
+				Code:     lastfm.ErrCodeInvalidParameters,
+				Message:  "dummy",
+				Attempts: 1,
+				FailedAt: time.Now(),
+			}))
+		}
+
+		return cfg
+	}
+
+	titles := func(t *testing.T, cfg config.Config) []string {
+		t.Helper()
+
+		j, err := openDeadLetters(cfg)
+		require.NoError(t, err)
+
+		deadLetters, err := j.Records()
+		require.NoError(t, err)
+
+		var result []string
+		for _, d := range deadLetters {
+			result = append(result, d.Track.Title)
+		}
+
+		return result
+	}
+
+	t.Run("List", func(t *testing.T) {
+		cfg := setup(t)
+
+		out, err := execute(t, newDeadLettersCmd(&cfg), "list", "-o", "json")
+		require.NoError(t, err)
+
+		var deadLetters []eventcmd.DeadLetter
+		require.NoError(t, json.Unmarshal([]byte(out), &deadLetters))
+		require.Len(t, deadLetters, 3)
+		assert.Equal(t, "First", deadLetters[0].Track.Title)
+		assert.Equal(t, lastfm.ErrCodeInvalidParameters, deadLetters[0].Code)
+	})
+
+	t.Run("Requeue", func(t *testing.T) {
+		cfg := setup(t)
+
+		_, err := execute(t, newDeadLettersCmd(&cfg), "requeue", "2", "0")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Second"}, titles(t, cfg))
+
+		w, err := openWAL(cfg)
+		require.NoError(t, err)
+
+		segments, err := w.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		require.Len(t, segments[0].Records(), 2)
+		assert.Equal(t, "First", segments[0].Records()[0].Title)
+		assert.Equal(t, "Third", segments[0].Records()[1].Title)
+	})
+
+	t.Run("Requeue With Correction", func(t *testing.T) {
+		cfg := setup(t)
+
+		_, err := execute(t, newDeadLettersCmd(&cfg), "requeue", "1", "--title", "Corrected")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"First", "Third"}, titles(t, cfg))
+
+		w, err := openWAL(cfg)
+		require.NoError(t, err)
+
+		segments, err := w.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		require.Len(t, segments[0].Records(), 1)
+		assert.Equal(t, "Corrected", segments[0].Records()[0].Title)
+	})
+
+	t.Run("Requeue No Such Dead Letter", func(t *testing.T) {
+		cfg := setup(t)
+
+		_, err := execute(t, newDeadLettersCmd(&cfg), "requeue", "3")
+		require.Error(t, err)
+		assert.Equal(t, []string{"First", "Second", "Third"}, titles(t, cfg))
+	})
+
+	t.Run("Requeue Invalid Correction", func(t *testing.T) {
+		cfg := setup(t)
+
+		_, err := execute(t, newDeadLettersCmd(&cfg), "requeue", "1", "--title", "")
+		require.ErrorIs(t, err, pianobar.ErrMissingTitle)
+		assert.Equal(t, []string{"First", "Second", "Third"}, titles(t, cfg))
+
+		w, err := openWAL(cfg)
+		require.NoError(t, err)
+		assert.True(t, w.Empty())
+	})
+
+	t.Run("Requeue Busy", func(t *testing.T) {
+		cfg := setup(t)
+
+		j, err := openDeadLetters(cfg)
+		require.NoError(t, err)
+
+		// Another requeue is already in progress
+		require.NoError(t, j.Process(func([]eventcmd.DeadLetter) ([]int, error) {
+			_, err := execute(t, newDeadLettersCmd(&cfg), "requeue", "0")
+			assert.ErrorIs(t, err, wal.ErrBusy)
+
+			return nil, nil
+		}))
+
+		assert.Equal(t, []string{"First", "Second", "Third"}, titles(t, cfg))
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		cfg := setup(t)
+
+		_, err := execute(t, newDeadLettersCmd(&cfg), "purge", "1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"First", "Third"}, titles(t, cfg))
+	})
+
+	t.Run("Purge All", func(t *testing.T) {
+		cfg := setup(t)
+
+		_, err := execute(t, newDeadLettersCmd(&cfg), "purge", "--all")
+		require.NoError(t, err)
+		assert.Empty(t, titles(t, cfg))
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cmd
+
+import "os/exec"
+
+// detach does nothing, since sessions are not supported on this platform. The child is started normally
+func detach(_ *exec.Cmd) {}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/pianobar/eventcmd"
+	"github.com/nlowe/pianoman/wal"
+)
+
+func newFlushCmd(cfg *config.Config) *cobra.Command {
+	var (
+		watch    bool
+		force    bool
+		interval time.Duration
+		jitter   time.Duration
+	)
+
+	result := &cobra.Command{
+		Use:   "flush",
+		Short: "Scrobble any tracks waiting in the WAL",
+		Long: "Send any requests queued by async mode, then try to scrobble the backlog of tracks waiting in the WAL once. With --watch, keep retrying until " +
+			"the WAL is empty, waiting for the specified interval (plus a random jitter) between attempts. Segments " +
+			"that recently failed are skipped until their backoff expires, and nothing is sent while Last.FM is " +
+			"unreachable, unless --force is specified.",
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			b, err := openBacklog(*cfg)
+			if err != nil {
+				return err
+			}
+
+			if force {
+				if err = b.WAL.ResetBackoff(); err != nil {
+					return err
+				}
+
+				if err = openBreaker(*cfg).Reset(); err != nil {
+					return err
+				}
+			}
+
+			for {
+				lfm, saveSession, err := newGuardedLastFM(ctx, *cfg)
+				if err != nil {
+					return err
+				}
+
+				if err = eventcmd.Drain(ctx, b, lfm, lfm); err != nil {
+					logrus.WithError(err).Warn("Failed to send queued requests")
+				}
+
+				if b.WAL.Empty() {
+					saveSession()
+					logrus.Info("WAL is empty")
+					return nil
+				}
+
+				err = eventcmd.Flush(ctx, b, lfm)
+				saveSession()
+
+				if errors.Is(err, wal.ErrBusy) {
+					// In async mode every event starts a flush, so another one is probably already scrobbling the
+					// backlog. It will pick up anything we would have.
+					logrus.Debug("WAL is already being processed by another flush")
+					return nil
+				}
+
+				if !watch {
+					return err
+				}
+
+				delay := interval
+				if jitter > 0 {
+					delay += time.Duration(rand.Int63n(int64(jitter)))
+				}
+
+				if err == nil {
+					if b.WAL.Empty() {
+						logrus.Info("WAL is empty")
+						return nil
+					}
+
+					logrus.Infof("Some tracks are waiting to be retried, checking again in %s", delay.Round(time.Second))
+				} else {
+					logrus.WithError(err).Warnf("Failed to scrobble backlog, retrying in %s", delay.Round(time.Second))
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(delay):
+				}
+			}
+		},
+	}
+
+	result.Flags().BoolVarP(&watch, "watch", "w", false, "Keep retrying until the WAL is empty")
+	result.Flags().BoolVarP(&force, "force", "f", false, "Retry segments that recently failed immediately, even if Last.FM was unreachable")
+	result.Flags().DurationVar(&interval, "interval", time.Minute, "How long to wait between attempts with --watch")
+	result.Flags().DurationVar(&jitter, "jitter", 30*time.Second, "Maximum random delay to add to --interval")
+
+	return result
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/wal"
+)
+
+func TestFlushCmd(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		cfg := testConfig(t)
+
+		_, err := execute(t, newFlushCmd(&cfg))
+		require.NoError(t, err)
+	})
+
+	t.Run("Busy", func(t *testing.T) {
+		cfg := testConfig(t)
+
+		w, err := openWAL(cfg)
+		require.NoError(t, err)
+		require.NoError(t, w.Append(pianobar.Track{Artist: "Test Artist", Title: "Test Title", ScrobbleAt: time.Now()}))
+
+		// Another flush is already processing the WAL
+		err = w.Process(func(_ wal.Segment[pianobar.Track]) ([]wal.Result, error) {
+			_, err := execute(t, newFlushCmd(&cfg))
+			assert.NoError(t, err)
+
+			return nil, wal.ErrSkipped
+		})
+		require.ErrorIs(t, err, wal.ErrSkipped)
+
+		assert.False(t, w.Empty())
+	})
+}
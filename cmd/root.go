@@ -1,24 +1,24 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
-	"strings"
-
-	"github.com/nlowe/pianoman/lazy"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/nlowe/pianoman/internal/config"
-	"github.com/nlowe/pianoman/lastfm"
-	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/internal/daemon"
+	"github.com/nlowe/pianoman/internal/redact"
 	"github.com/nlowe/pianoman/pianobar/eventcmd"
-	"github.com/nlowe/pianoman/wal"
 )
 
 func NewRootCmd() *cobra.Command {
@@ -57,6 +57,9 @@ func NewRootCmd() *cobra.Command {
 
 			cfg.Path = configFilePath
 
+			// Make sure we never log any secrets from the config
+			redact.Add(cfg.Auth.API.Secret, cfg.Auth.User.Password)
+
 			// Update Logger
 			lvl, err := logrus.ParseLevel(cfg.Verbosity)
 			if err != nil {
@@ -70,74 +73,114 @@ func NewRootCmd() *cobra.Command {
 			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 			defer cancel()
 
-			// Normalize WAL Path
-			w, err := wal.Open[pianobar.Track](filepath.Join(
-				filepath.Dir(cfg.Path), filepath.Clean(cfg.Scrobble.WALDirectory),
-			), lastfm.MaxTracksPerScrobble)
-
+			// Save the event payload, so it can be forwarded and re-read by chained commands
+			payload, err := io.ReadAll(os.Stdin)
 			if err != nil {
-				return fmt.Errorf("failed to open wal: %w", err)
+				return fmt.Errorf("failed to read eventcmd payload: %w", err)
 			}
 
-			sessionTokenCachePath := filepath.Join(
-				filepath.Dir(cfg.Path), "session",
-			)
+			// Don't hold up pianobar for longer than the budget, anything left over will be retried later
+			budget, cancelBudget := withBudget(ctx, cfg)
+			if cfg.EventCMD.Async {
+				err = queueEvent(budget, cfg, args[0], payload)
+			} else {
+				err = forwardEvent(budget, cfg, args[0], payload)
+			}
+			cancelBudget()
 
-			sessionTokenCache := lazy.New[string](func() {
-				logrus.Debug("Deleting Session Token")
-				_ = os.Remove(sessionTokenCachePath)
-			})
+			// Chained programs are invoked regardless of whether we were able to handle the event
+			return errors.Join(err, eventcmd.Chain(ctx, args[0], bytes.NewReader(payload), chainedCommands(cfg)...))
+		},
+	}
 
-			defer func() {
-				token := sessionTokenCache.Fetch(func() string {
-					return ""
-				})
-
-				if token == "" {
-					logrus.Warn("No token to cache")
-					return
-				}
-
-				// Try to cache the token
-				logrus.Debug("Caching session token")
-				if err = os.WriteFile(sessionTokenCachePath, []byte(token), 0o600); err != nil {
-					logrus.WithError(err).Error("Failed to cache session token")
-				}
-			}()
+	result.AddCommand(newAuthCmd(&cfg))
+	result.AddCommand(newDaemonCmd(&cfg))
+	result.AddCommand(newDeadLettersCmd(&cfg))
+	result.AddCommand(newFlushCmd(&cfg))
+	result.AddCommand(newWALCmd(&cfg))
 
-			cachedToken, err := os.ReadFile(sessionTokenCachePath)
-			if err == nil {
-				logrus.Debug("Using cached session token")
-				_ = sessionTokenCache.Fetch(func() string {
-					return strings.TrimSpace(string(cachedToken))
-				})
-			}
+	return result
+}
 
-			lfm := lastfm.New(
-				sessionTokenCache,
-				cfg.Auth.API.Key,
-				cfg.Auth.API.Secret,
-				cfg.Auth.User.Name,
-				cfg.Auth.User.Password,
-			)
-
-			flags := eventcmd.HandleSongFinish
-			if cfg.Scrobble.NowPlaying {
-				flags |= eventcmd.HandleSongStart
-			}
+// forwardEvent forwards the specified eventcmd event to the daemon, falling back to handling it in-process if the
+// daemon is not running.
+func forwardEvent(ctx context.Context, cfg config.Config, event string, payload []byte) error {
+	if !handleFlags(cfg).ShouldHandle(event) {
+		logrus.Tracef("Ignoring %s due to flags", event)
+		return nil
+	}
 
-			if cfg.Scrobble.Thumbs {
-				flags |= eventcmd.HandleSongLove
-				flags |= eventcmd.HandleSongBan
-			}
+	err := daemon.Forward(ctx, cfg.Resolve(cfg.Daemon.Socket), event, payload)
+	if errors.Is(err, daemon.ErrNotRunning) {
+		logrus.WithError(err).Debug("Handling event in-process")
+		return handleEvent(ctx, cfg, event, bytes.NewReader(payload))
+	}
 
-			// TODO: Don't scrobble thumbs down if configured
+	return err
+}
 
-			// TODO: Support eventcmd chaining
-			_, err = eventcmd.Handle(ctx, args[0], flags, os.Stdin, w, lfm, lfm)
-			return err
-		},
+// queueEvent handles the specified eventcmd event without waiting for Last.FM. Tracks to scrobble are appended to the
+// WAL and other requests are queued, then a detached `pianoman flush` is started to send them.
+func queueEvent(ctx context.Context, cfg config.Config, event string, payload []byte) error {
+	flags := handleFlags(cfg)
+	if !flags.ShouldHandle(event) {
+		logrus.Tracef("Ignoring %s due to flags", event)
+		return nil
 	}
 
-	return result
+	b, err := openBacklog(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is sent to Last.FM with Defer, so there's no need for a client
+	if _, err = eventcmd.Handle(ctx, event, flags|eventcmd.Defer, bytes.NewReader(payload), b, nil, nil); err != nil {
+		return err
+	}
+
+	return startFlush()
+}
+
+// startFlush starts `pianoman flush` in the background, without waiting for it to finish
+func startFlush() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to start background flush: %w", err)
+	}
+
+	cmd := exec.Command(exe, "flush")
+	detach(cmd)
+
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start background flush: %w", err)
+	}
+
+	logrus.Debugf("Started background flush with pid %d", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// handleEvent handles the specified eventcmd event in-process
+func handleEvent(ctx context.Context, cfg config.Config, event string, payload io.Reader) error {
+	b, err := openBacklog(cfg)
+	if err != nil {
+		return err
+	}
+
+	lfm, saveSession, err := newGuardedLastFM(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer saveSession()
+
+	_, err = eventcmd.Handle(ctx, event, handleFlags(cfg), payload, b, lfm, lfm)
+	return err
+}
+
+// withBudget limits ctx to the time allowed for handling an event by eventcmd.budget
+func withBudget(ctx context.Context, cfg config.Config) (context.Context, context.CancelFunc) {
+	if cfg.EventCMD.Budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, cfg.EventCMD.Budget)
 }
@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nlowe/pianoman/internal/breaker"
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/internal/flock"
+	"github.com/nlowe/pianoman/internal/redact"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/lazy"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/pianobar/eventcmd"
+	"github.com/nlowe/pianoman/wal"
+)
+
+// openWAL opens the WAL configured by scrobble.wal
+func openWAL(cfg config.Config) (*wal.WAL[pianobar.Track], error) {
+	w, err := wal.Open[pianobar.Track](
+		cfg.Resolve(cfg.Scrobble.WALDirectory),
+		lastfm.MaxTracksPerScrobble,
+		wal.WithLockTimeout(cfg.LockTimeout),
+		wal.WithBackoff(cfg.Scrobble.Backoff.Initial, cfg.Scrobble.Backoff.Max),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	return w, nil
+}
+
+// openBacklog opens the WAL as well as the journals configured by scrobble.rejectedLog, scrobble.deadLetters and
+// scrobble.pending, and the play state configured by scrobble.playState.
+// Tracks older than scrobble.maxAge are given up on.
+func openBacklog(cfg config.Config) (eventcmd.Backlog, error) {
+	w, err := openWAL(cfg)
+	if err != nil {
+		return eventcmd.Backlog{}, err
+	}
+
+	rejected, err := wal.OpenJournal[eventcmd.Rejection](cfg.Resolve(cfg.Scrobble.RejectedLog), wal.WithLockTimeout(cfg.LockTimeout))
+	if err != nil {
+		return eventcmd.Backlog{}, fmt.Errorf("failed to open rejected log: %w", err)
+	}
+
+	deadLetters, err := openDeadLetters(cfg)
+	if err != nil {
+		return eventcmd.Backlog{}, err
+	}
+
+	pending, err := wal.OpenJournal[eventcmd.Operation](cfg.Resolve(cfg.Scrobble.Pending), wal.WithLockTimeout(cfg.LockTimeout))
+	if err != nil {
+		return eventcmd.Backlog{}, fmt.Errorf("failed to open pending requests: %w", err)
+	}
+
+	playing, err := eventcmd.OpenPlayState(cfg.Resolve(cfg.Scrobble.PlayState), cfg.LockTimeout)
+	if err != nil {
+		return eventcmd.Backlog{}, err
+	}
+
+	return eventcmd.Backlog{
+		WAL:         w,
+		Rejected:    rejected,
+		DeadLetters: deadLetters,
+		Pending:     pending,
+		Playing:     playing,
+		MaxAge:      cfg.Scrobble.MaxAge,
+	}, nil
+}
+
+// openDeadLetters opens the dead-letter journal configured by scrobble.deadLetters
+func openDeadLetters(cfg config.Config) (*wal.Journal[eventcmd.DeadLetter], error) {
+	j, err := wal.OpenJournal[eventcmd.DeadLetter](cfg.Resolve(cfg.Scrobble.DeadLetters), wal.WithLockTimeout(cfg.LockTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letters: %w", err)
+	}
+
+	return j, nil
+}
+
+// sessionPath returns the path to the file the Last.FM session key is cached in
+func sessionPath(cfg config.Config) string {
+	return cfg.Resolve("session")
+}
+
+// lockSession takes the lock guarding the session file, so multiple processes don't try to update it at once. It waits
+// until ctx is done at most.
+func lockSession(ctx context.Context, cfg config.Config) (*flock.Lock, error) {
+	l, err := flock.Acquire(ctx, sessionPath(cfg)+".lock", cfg.LockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock session: %w", err)
+	}
+
+	return l, nil
+}
+
+// readSession reads the cached Last.FM session key, if any
+func readSession(ctx context.Context, cfg config.Config) (string, error) {
+	l, err := lockSession(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		_ = l.Release()
+	}()
+
+	v, err := os.ReadFile(sessionPath(cfg))
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(v))
+	redact.Add(key)
+
+	return key, nil
+}
+
+// writeSession caches the specified Last.FM session key
+func writeSession(cfg config.Config, key string) error {
+	l, err := lockSession(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = l.Release()
+	}()
+
+	return os.WriteFile(sessionPath(cfg), []byte(key), 0o600)
+}
+
+// removeSession deletes the cached Last.FM session key
+func removeSession(cfg config.Config) error {
+	l, err := lockSession(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = l.Release()
+	}()
+
+	return os.Remove(sessionPath(cfg))
+}
+
+// newLastFM constructs a Last.FM client using the cached session token, if any. The returned function caches the
+// session token used by the client, and should be called once the client is no longer needed. The cached session token
+// is only deleted if Last.FM says it is no longer valid. Any extra options are applied after the ones from the config.
+// Reading the cached session token waits until ctx is done at most.
+func newLastFM(ctx context.Context, cfg config.Config, extra ...lastfm.Option) (*lastfm.API, func(), error) {
+	opts, err := lastfmOptions(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts = append(opts, lastfm.WithSessionExpired(func() {
+		logrus.Debug("Deleting Session Token")
+		_ = removeSession(cfg)
+	}))
+	opts = append(opts, extra...)
+
+	sessionTokenCache := lazy.New[string](func() {
+		logrus.Debug("Forgetting Session Token")
+	})
+
+	cachedToken, err := readSession(ctx, cfg)
+	if err == nil {
+		logrus.Debug("Using cached session token")
+		_ = sessionTokenCache.Fetch(func() string {
+			return cachedToken
+		})
+	}
+
+	lfm := lastfm.New(
+		sessionTokenCache,
+		cfg.Auth.API.Key,
+		cfg.Auth.API.Secret,
+		cfg.Auth.User.Name,
+		cfg.Auth.User.Password,
+		opts...,
+	)
+
+	return lfm, func() {
+		token := sessionTokenCache.Fetch(func() string {
+			return ""
+		})
+
+		if token == "" {
+			logrus.Warn("No token to cache")
+			return
+		}
+
+		// Try to cache the token
+		logrus.Debug("Caching session token")
+		if err := writeSession(cfg, token); err != nil {
+			logrus.WithError(err).Error("Failed to cache session token")
+		}
+	}, nil
+}
+
+// lastfmOptions configures Last.FM clients according to the http config
+func lastfmOptions(cfg config.Config) ([]lastfm.Option, error) {
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return []lastfm.Option{
+		lastfm.WithHTTPClient(client),
+		lastfm.WithUserAgent(cfg.HTTP.UserAgent),
+		lastfm.WithRequestTimeout(cfg.HTTP.Timeout),
+	}, nil
+}
+
+// newHTTPClient constructs the HTTP client used to send requests to Last.FM, configured by http.caBundle and
+// http.proxy
+func newHTTPClient(cfg config.Config) (*http.Client, error) {
+	transport := cleanhttp.DefaultTransport()
+
+	if cfg.HTTP.CABundle != "" {
+		pem, err := os.ReadFile(cfg.Resolve(cfg.HTTP.CABundle))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to load system certificates, only trusting the configured CA bundle")
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to read CA bundle: no certificates found in %s", cfg.HTTP.CABundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	if cfg.HTTP.Proxy != "" {
+		proxy, err := url.Parse(cfg.HTTP.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy: %w", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// breakerPath returns the path to the file the circuit breaker state is saved in, next to the session file
+func breakerPath(cfg config.Config) string {
+	return cfg.Resolve("breaker.json")
+}
+
+// openBreaker returns the circuit breaker guarding requests to Last.FM
+func openBreaker(cfg config.Config) *breaker.Breaker {
+	return breaker.New(breakerPath(cfg), cfg.Breaker.Threshold, cfg.Breaker.CoolOff, cfg.LockTimeout, lastfm.IsUnreachable)
+}
+
+// newGuardedLastFM constructs a Last.FM client like newLastFM, skipping requests while the circuit breaker is open
+func newGuardedLastFM(ctx context.Context, cfg config.Config) (*lastfm.Guarded, func(), error) {
+	lfm, saveSession, err := newLastFM(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lastfm.NewGuarded(lfm, lfm, openBreaker(cfg)), saveSession, nil
+}
+
+// handleFlags determines which events should be handled based on the scrobble config
+func handleFlags(cfg config.Config) eventcmd.EventFlags {
+	flags := eventcmd.HandleSongFinish
+	if cfg.Scrobble.NowPlaying {
+		flags |= eventcmd.HandleSongStart
+	}
+
+	if cfg.Scrobble.Thumbs {
+		flags |= eventcmd.HandleSongLove
+		flags |= eventcmd.HandleSongBan
+	}
+
+	if cfg.Scrobble.IgnoreThumbsDown {
+		flags |= eventcmd.IgnoreThumbsDown
+	}
+
+	if cfg.Scrobble.IgnorePianobarErrors {
+		flags |= eventcmd.IgnorePianobarErrors
+	}
+
+	return flags
+}
+
+// chainedCommands converts the eventcmd.next config to the programs to chain to
+func chainedCommands(cfg config.Config) []eventcmd.Next {
+	result := make([]eventcmd.Next, 0, len(cfg.EventCMD.Next))
+	for _, n := range cfg.EventCMD.Next {
+		result = append(result, eventcmd.Next{
+			Command: n.Command,
+			Timeout: n.Timeout,
+			Events:  n.Events,
+		})
+	}
+
+	return result
+}
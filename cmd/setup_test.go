@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/pianobar"
+)
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// testConfig returns the default config, with all files resolved relative to a temporary directory
+func testConfig(t *testing.T) config.Config {
+	t.Helper()
+
+	cfg, err := config.Parse(strings.NewReader(`verbosity: info`))
+	require.NoError(t, err)
+	cfg.Path = filepath.Join(t.TempDir(), "config.yaml")
+
+	return cfg
+}
+
+// execute runs cmd with the specified arguments, returning what it wrote to stdout
+func execute(t *testing.T, cmd *cobra.Command, args ...string) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs(args)
+
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestNewLastFM_CachedSession(t *testing.T) {
+	for _, tt := range []struct {
+		code    int
+		removed bool
+	}{
+		{code: lastfm.ErrCodeInvalidParameters},
+		{code: lastfm.ErrCodeInvalidAPIKey},
+		{code: lastfm.ErrCodeTemporarilyUnavailable},
+		{code: lastfm.ErrCodeRateLimitExceeded},
+		{code: lastfm.ErrCodeInvalidSessionKey, removed: true},
+		{code: lastfm.ErrCodeTokenExpired, removed: true},
+	} {
+		t.Run(fmt.Sprint(tt.code), func(t *testing.T) {
+			cfg := testConfig(t)
+			require.NoError(t, writeSession(cfg, "cached"))
+
+			client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`<lfm status="failed"><error code="%d">dummy</error></lfm>`, tt.code))),
+				}, nil
+			})}
+
+			lfm, saveSession, err := newLastFM(context.Background(), cfg, lastfm.WithHTTPClient(client))
+			require.NoError(t, err)
+
+			require.Error(t, lfm.LoveTrack(context.Background(), pianobar.Track{Artist: "Test Artist", Title: "Test Title"}))
+			saveSession()
+
+			v, err := os.ReadFile(sessionPath(cfg))
+			if tt.removed {
+				require.ErrorIs(t, err, os.ErrNotExist)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "cached", string(v))
+		})
+	}
+}
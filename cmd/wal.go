@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/wal"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func newWALCmd(cfg *config.Config) *cobra.Command {
+	result := &cobra.Command{
+		Use:   "wal",
+		Short: "Inspect and manage tracks waiting to be scrobbled",
+	}
+
+	result.AddCommand(newWALListCmd(cfg))
+	result.AddCommand(newWALShowCmd(cfg))
+	result.AddCommand(newWALDropCmd(cfg))
+
+	return result
+}
+
+type walSegmentSummary struct {
+	Index     int       `json:"index"`
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Records   int       `json:"records"`
+	Oldest    time.Time `json:"oldest,omitempty"`
+
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+}
+
+func newWALListCmd(cfg *config.Config) *cobra.Command {
+	var output string
+
+	result := &cobra.Command{
+		Use:   "list",
+		Short: "List WAL segments",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			w, err := openWAL(*cfg)
+			if err != nil {
+				return err
+			}
+
+			segments, err := w.Segments()
+			if err != nil {
+				return err
+			}
+
+			summaries := make([]walSegmentSummary, 0, len(segments))
+			for i, segment := range segments {
+				summary := walSegmentSummary{
+					Index:     i,
+					ID:        segment.ID().String(),
+					CreatedAt: segment.CreatedAt(),
+					Records:   segment.Length(),
+
+					Attempts:    segment.Metadata().Attempts,
+					LastError:   segment.Metadata().LastError,
+					NextAttempt: segment.Metadata().NextAttempt,
+				}
+
+				for _, r := range segment.Records() {
+					if summary.Oldest.IsZero() || r.ScrobbleAt.Before(summary.Oldest) {
+						summary.Oldest = r.ScrobbleAt
+					}
+				}
+
+				summaries = append(summaries, summary)
+			}
+
+			return writeOutput(cmd.OutOrStdout(), output, summaries, func(tw io.Writer) {
+				_, _ = fmt.Fprintln(tw, "INDEX\tSEGMENT\tCREATED\tRECORDS\tOLDEST RECORD\tATTEMPTS\tNEXT ATTEMPT")
+				for _, s := range summaries {
+					next := "now"
+					if time.Now().Before(s.NextAttempt) {
+						next = s.NextAttempt.Local().Format(time.DateTime)
+					}
+
+					_, _ = fmt.Fprintf(
+						tw, "%d\t%s\t%s\t%d\t%s ago\t%d\t%s\n",
+						s.Index, s.ID, s.CreatedAt.Local().Format(time.DateTime), s.Records,
+						time.Since(s.Oldest).Round(time.Second), s.Attempts, next,
+					)
+				}
+			})
+		},
+	}
+
+	addOutputFlag(result, &output)
+	return result
+}
+
+func newWALShowCmd(cfg *config.Config) *cobra.Command {
+	var output string
+
+	result := &cobra.Command{
+		Use:   "show <segment>",
+		Short: "Show the records in a WAL segment",
+		Long:  "Show the records in a WAL segment. The segment may be specified by ID or by its index from 'wal list'.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w, err := openWAL(*cfg)
+			if err != nil {
+				return err
+			}
+
+			segment, err := findSegment(w, args[0])
+			if err != nil {
+				return err
+			}
+
+			records := segment.Records()
+			return writeOutput(cmd.OutOrStdout(), output, records, func(tw io.Writer) {
+				_, _ = fmt.Fprintln(tw, "INDEX\tSCROBBLE AT\tARTIST\tTITLE\tALBUM\tPLAYED")
+				for i, r := range records {
+					played := fmt.Sprintf("%s/%s", r.SongPlayed, r.SongDuration)
+					if r.Recovered {
+						played += " (recovered)"
+					}
+
+					_, _ = fmt.Fprintf(
+						tw, "%d\t%s\t%s\t%s\t%s\t%s\n",
+						i, r.ScrobbleAt.Local().Format(time.DateTime), r.Artist, r.Title, r.Album, played,
+					)
+				}
+			})
+		},
+	}
+
+	addOutputFlag(result, &output)
+	return result
+}
+
+func newWALDropCmd(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "drop <segment> [record]",
+		Short: "Remove a segment or a single record from the WAL",
+		Long: "Remove a segment or a single record from the WAL. The segment may be specified by ID or by its index " +
+			"from 'wal list', and the record by its index from 'wal show'. Dropped records are never scrobbled.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			w, err := openWAL(*cfg)
+			if err != nil {
+				return err
+			}
+
+			segment, err := findSegment(w, args[0])
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				logrus.Infof("Dropping segment %s with %d record(s)", segment.ID().String(), segment.Length())
+				return w.DropSegment(segment.ID())
+			}
+
+			index, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid record index %s: %w", args[1], err)
+			}
+
+			dropped, err := w.DropRecord(segment.ID(), index)
+			if err != nil {
+				return err
+			}
+
+			logrus.Infof("Dropped %s - %s from segment %s", dropped.Artist, dropped.Title, segment.ID().String())
+			return nil
+		},
+	}
+}
+
+// findSegment finds a segment in the WAL by its ID or its index
+func findSegment(w *wal.WAL[pianobar.Track], v string) (wal.Segment[pianobar.Track], error) {
+	segments, err := w.Segments()
+	if err != nil {
+		return wal.Segment[pianobar.Track]{}, err
+	}
+
+	if index, err := strconv.Atoi(v); err == nil {
+		if index < 0 || index >= len(segments) {
+			return wal.Segment[pianobar.Track]{}, fmt.Errorf("segment %d: %w", index, wal.ErrNoSuchSegment)
+		}
+
+		return segments[index], nil
+	}
+
+	id, err := ulid.ParseStrict(v)
+	if err != nil {
+		return wal.Segment[pianobar.Track]{}, fmt.Errorf("invalid segment %s: %w", v, err)
+	}
+
+	for _, segment := range segments {
+		if segment.ID() == id {
+			return segment, nil
+		}
+	}
+
+	return wal.Segment[pianobar.Track]{}, fmt.Errorf("segment %s: %w", v, wal.ErrNoSuchSegment)
+}
+
+func addOutputFlag(cmd *cobra.Command, output *string) {
+	cmd.Flags().StringVarP(output, "output", "o", outputTable, "Output format. One of: table, json")
+}
+
+// writeOutput writes v to w as JSON, or as a table using the provided function
+func writeOutput(w io.Writer, output string, v any, table func(tw io.Writer)) error {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", output)
+	}
+}
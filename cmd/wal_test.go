@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/internal/config"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/wal"
+)
+
+func TestWALCmd(t *testing.T) {
+	setup := func(t *testing.T) (config.Config, *wal.WAL[pianobar.Track]) {
+		t.Helper()
+
+		cfg := testConfig(t)
+
+		w, err := openWAL(cfg)
+		require.NoError(t, err)
+
+		for _, title := range []string{"First", "Second"} {
+			require.NoError(t, w.Append(pianobar.Track{Artist: "Test Artist", Title: title, ScrobbleAt: time.Now()}))
+		}
+
+		return cfg, w
+	}
+
+	t.Run("List", func(t *testing.T) {
+		cfg, w := setup(t)
+
+		out, err := execute(t, newWALCmd(&cfg), "list", "-o", "json")
+		require.NoError(t, err)
+
+		var summaries []walSegmentSummary
+		require.NoError(t, json.Unmarshal([]byte(out), &summaries))
+		require.Len(t, summaries, 1)
+
+		segments, err := w.Segments()
+		require.NoError(t, err)
+		assert.Equal(t, segments[0].ID().String(), summaries[0].ID)
+		assert.Equal(t, 2, summaries[0].Records)
+	})
+
+	t.Run("Show", func(t *testing.T) {
+		cfg, _ := setup(t)
+
+		out, err := execute(t, newWALCmd(&cfg), "show", "0", "-o", "json")
+		require.NoError(t, err)
+
+		var records []pianobar.Track
+		require.NoError(t, json.Unmarshal([]byte(out), &records))
+		require.Len(t, records, 2)
+		assert.Equal(t, "First", records[0].Title)
+		assert.Equal(t, "Second", records[1].Title)
+	})
+
+	t.Run("Show No Such Segment", func(t *testing.T) {
+		cfg, _ := setup(t)
+
+		_, err := execute(t, newWALCmd(&cfg), "show", "1")
+		require.ErrorIs(t, err, wal.ErrNoSuchSegment)
+	})
+
+	t.Run("Drop Record", func(t *testing.T) {
+		cfg, w := setup(t)
+
+		_, err := execute(t, newWALCmd(&cfg), "drop", "0", "0")
+		require.NoError(t, err)
+
+		segments, err := w.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		require.Len(t, segments[0].Records(), 1)
+		assert.Equal(t, "Second", segments[0].Records()[0].Title)
+	})
+
+	t.Run("Drop Segment", func(t *testing.T) {
+		cfg, w := setup(t)
+
+		_, err := execute(t, newWALCmd(&cfg), "drop", "0")
+		require.NoError(t, err)
+		assert.True(t, w.Empty())
+	})
+}
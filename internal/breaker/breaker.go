@@ -0,0 +1,225 @@
+// Package breaker implements a circuit breaker whose state is shared between processes through a file on disk
+package breaker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nlowe/pianoman/internal/flock"
+)
+
+var log = logrus.WithField("prefix", "breaker")
+
+// ErrOpen is returned instead of calling the protected function while the circuit is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is the state of a circuit breaker, as saved to disk
+type State struct {
+	// Failures is the number of consecutive failures
+	Failures int `json:"failures"`
+	// OpenUntil is when the cool-off period ends and a probe may be sent. The circuit is closed if it is zero.
+	OpenUntil time.Time `json:"openUntil,omitempty"`
+	// ProbeStarted is when a process started probing the service, if a probe is in flight
+	ProbeStarted time.Time `json:"probeStarted,omitempty"`
+}
+
+// Open returns true iff the circuit is open or half-open
+func (s State) Open() bool {
+	return !s.OpenUntil.IsZero()
+}
+
+// Breaker skips calls to a service after a number of consecutive failures, until a cool-off period has passed. Once
+// it has, a single call is let through to probe the service. If it succeeds the circuit is closed, otherwise it is
+// opened for another cool-off period.
+type Breaker struct {
+	path        string
+	threshold   int
+	coolOff     time.Duration
+	lockTimeout time.Duration
+
+	// isFailure determines which errors count towards opening the circuit
+	isFailure func(error) bool
+}
+
+// New creates a Breaker that saves its state to the file at path. The circuit opens after threshold consecutive
+// errors for which isFailure returns true, and stays open for coolOff. A threshold of zero disables the breaker.
+func New(path string, threshold int, coolOff, lockTimeout time.Duration, isFailure func(error) bool) *Breaker {
+	return &Breaker{
+		path:        path,
+		threshold:   threshold,
+		coolOff:     coolOff,
+		lockTimeout: lockTimeout,
+		isFailure:   isFailure,
+	}
+}
+
+// Do calls fn unless the circuit is open, in which case an error wrapping ErrOpen is returned without calling fn.
+// The result of fn is recorded, and any error it returns is returned as-is. fn should stop when ctx is done. If it
+// fails after ctx is done, the failure was caused by the caller giving up rather than the service, so it isn't
+// recorded.
+func (b *Breaker) Do(ctx context.Context, fn func() error) error {
+	if b.threshold <= 0 {
+		return fn()
+	}
+
+	probe, err := b.allow(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err != nil && ctx.Err() != nil {
+		if probe {
+			b.abandon()
+		}
+
+		return err
+	}
+
+	if recordErr := b.record(probe, err != nil && b.isFailure(err)); recordErr != nil {
+		log.WithError(recordErr).Warn("Failed to save circuit breaker state")
+	}
+
+	return err
+}
+
+// State returns the current state of the circuit
+func (b *Breaker) State() (State, error) {
+	var s State
+	err := b.update(context.Background(), func(v *State) (bool, error) {
+		s = *v
+		return false, nil
+	})
+
+	return s, err
+}
+
+// Reset closes the circuit
+func (b *Breaker) Reset() error {
+	return b.update(context.Background(), func(s *State) (bool, error) {
+		*s = State{}
+		return true, nil
+	})
+}
+
+// allow returns nil if fn may be called, and whether the call is a probe
+func (b *Breaker) allow(ctx context.Context) (bool, error) {
+	var probe bool
+	err := b.update(ctx, func(s *State) (bool, error) {
+		if !s.Open() {
+			return false, nil
+		}
+
+		now := time.Now()
+		if now.Before(s.OpenUntil) {
+			return false, fmt.Errorf("%w until %s", ErrOpen, s.OpenUntil.Local().Format(time.DateTime))
+		}
+
+		// Only one process may probe the service at a time. If the probe never finished (for example, because the
+		// process was killed) another one may be sent after the cool-off period.
+		if !s.ProbeStarted.IsZero() && now.Before(s.ProbeStarted.Add(b.coolOff)) {
+			return false, fmt.Errorf("%w: waiting for another process to check if the service is available", ErrOpen)
+		}
+
+		log.Debug("Cool-off period has passed, probing service")
+		s.ProbeStarted = now
+		probe = true
+		return true, nil
+	})
+
+	if err != nil && ctx.Err() != nil {
+		return false, err
+	}
+
+	if err != nil && !errors.Is(err, ErrOpen) {
+		// Don't stop calling the service just because we can't keep track of it
+		log.WithError(err).Warn("Failed to read circuit breaker state")
+		return false, nil
+	}
+
+	return probe, err
+}
+
+// record records the outcome of a call. probe is true if the call was a probe.
+func (b *Breaker) record(probe, failed bool) error {
+	return b.update(context.Background(), func(s *State) (bool, error) {
+		if !failed {
+			if probe || s.Open() {
+				log.Info("Service is available again, closing circuit")
+			}
+
+			changed := s.Failures != 0 || s.Open()
+			*s = State{}
+			return changed, nil
+		}
+
+		s.Failures++
+		if probe || (!s.Open() && s.Failures >= b.threshold) {
+			log.Warnf("Service is unavailable after %d consecutive failure(s), skipping calls for %s", s.Failures, b.coolOff)
+			s.OpenUntil = time.Now().Add(b.coolOff)
+			s.ProbeStarted = time.Time{}
+		}
+
+		return true, nil
+	})
+}
+
+// abandon forgets a probe whose outcome is unknown, so another one may be sent without waiting for it to go stale
+func (b *Breaker) abandon() {
+	err := b.update(context.Background(), func(s *State) (bool, error) {
+		s.ProbeStarted = time.Time{}
+		return true, nil
+	})
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to save circuit breaker state")
+	}
+}
+
+// update locks the state file and calls fn with the current state. If fn returns true, the state is saved. Waiting
+// for the lock stops when ctx is done.
+func (b *Breaker) update(ctx context.Context, fn func(s *State) (bool, error)) error {
+	l, err := flock.Acquire(ctx, b.path+".lock", b.lockTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to lock circuit breaker state: %w", err)
+	}
+
+	defer func() {
+		_ = l.Release()
+	}()
+
+	var s State
+	v, err := os.ReadFile(b.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read circuit breaker state: %w", err)
+	}
+
+	if len(v) > 0 {
+		if err = json.Unmarshal(v, &s); err != nil {
+			log.WithError(err).Warn("Circuit breaker state is corrupt, resetting it")
+			s = State{}
+		}
+	}
+
+	save, err := fn(&s)
+	if err != nil || !save {
+		return err
+	}
+
+	v, err = json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode circuit breaker state: %w", err)
+	}
+
+	if err = os.WriteFile(b.path, v, 0o600); err != nil {
+		return fmt.Errorf("failed to save circuit breaker state: %w", err)
+	}
+
+	return nil
+}
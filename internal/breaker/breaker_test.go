@@ -0,0 +1,135 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errOffline = errors.New("offline")
+	errOther   = errors.New("other")
+)
+
+func isOffline(err error) bool {
+	return errors.Is(err, errOffline)
+}
+
+func TestBreaker(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "breaker.json")
+	sut := New(p, 2, 50*time.Millisecond, time.Second, isOffline)
+
+	calls := 0
+	call := func(err error) func() error {
+		return func() error {
+			calls++
+			return err
+		}
+	}
+
+	// Errors that aren't failures don't count towards opening the circuit
+	require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+	require.ErrorIs(t, sut.Do(context.Background(), call(errOther)), errOther)
+	require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+
+	s, err := sut.State()
+	require.NoError(t, err)
+	require.Equal(t, 1, s.Failures)
+	require.False(t, s.Open())
+
+	require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+	require.Equal(t, 4, calls)
+
+	// The circuit is open, so nothing should be called
+	require.ErrorIs(t, sut.Do(context.Background(), call(nil)), ErrOpen)
+	require.Equal(t, 4, calls)
+
+	t.Run("Shared", func(t *testing.T) {
+		other := New(p, 2, 50*time.Millisecond, time.Second, isOffline)
+		require.ErrorIs(t, other.Do(context.Background(), call(nil)), ErrOpen)
+		require.Equal(t, 4, calls)
+	})
+
+	t.Run("Failed Probe", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+
+		require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+		require.Equal(t, 5, calls)
+
+		require.ErrorIs(t, sut.Do(context.Background(), call(nil)), ErrOpen)
+		require.Equal(t, 5, calls)
+	})
+
+	t.Run("Single Probe", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+
+		require.NoError(t, sut.Do(context.Background(), func() error {
+			calls++
+
+			// Other calls must wait for the probe to finish
+			assert.ErrorIs(t, sut.Do(context.Background(), call(nil)), ErrOpen)
+			return nil
+		}))
+		require.Equal(t, 6, calls)
+
+		s, err := sut.State()
+		require.NoError(t, err)
+		require.Equal(t, State{}, s)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+		require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+		require.ErrorIs(t, sut.Do(context.Background(), call(nil)), ErrOpen)
+
+		require.NoError(t, sut.Reset())
+		require.NoError(t, sut.Do(context.Background(), call(nil)))
+	})
+
+	t.Run("Caller Gave Up", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "breaker.json")
+		sut := New(p, 1, 50*time.Millisecond, time.Second, isOffline)
+
+		giveUp := func() error {
+			ctx, cancel := context.WithCancel(context.Background())
+			return sut.Do(ctx, func() error {
+				cancel()
+				return errOffline
+			})
+		}
+
+		require.ErrorIs(t, giveUp(), errOffline)
+
+		s, err := sut.State()
+		require.NoError(t, err)
+		require.Equal(t, State{}, s, "failures after the caller gave up should not be counted")
+
+		// Probes abandoned by the caller don't count either, and another probe may be sent right away
+		require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+		time.Sleep(60 * time.Millisecond)
+		require.ErrorIs(t, giveUp(), errOffline)
+
+		s, err = sut.State()
+		require.NoError(t, err)
+		require.True(t, s.Open())
+		require.Equal(t, 1, s.Failures)
+		require.Zero(t, s.ProbeStarted)
+
+		require.NoError(t, sut.Do(context.Background(), call(nil)))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "breaker.json")
+		sut := New(p, 0, time.Hour, time.Second, isOffline)
+		for i := 0; i < 5; i++ {
+			require.ErrorIs(t, sut.Do(context.Background(), call(errOffline)), errOffline)
+		}
+
+		assert.NoFileExists(t, p)
+	})
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"io"
+	"path/filepath"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
@@ -12,13 +15,27 @@ type Config struct {
 	Auth     AuthConfig     `yaml:"auth"`
 	Scrobble ScrobbleConfig `yaml:"scrobble"`
 
-	EventCMD EventConfig `yaml:"eventcmd"`
+	EventCMD EventConfig   `yaml:"eventcmd"`
+	Daemon   DaemonConfig  `yaml:"daemon"`
+	Breaker  BreakerConfig `yaml:"breaker"`
+	HTTP     HTTPConfig    `yaml:"http"`
 
-	Verbosity string `yaml:"verbosity"`
+	LockTimeout time.Duration `yaml:"lockTimeout"`
+	Verbosity   string        `yaml:"verbosity"`
 
 	Path string `yaml:"-"`
 }
 
+// Resolve returns the path to p relative to the directory containing the config file. If p is absolute, it is
+// returned as-is.
+func (c Config) Resolve(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+
+	return filepath.Join(filepath.Dir(c.Path), filepath.Clean(p))
+}
+
 type AuthConfig struct {
 	API  APICredentials `yaml:"api"`
 	User User           `yaml:"user"`
@@ -38,12 +55,96 @@ type ScrobbleConfig struct {
 	NowPlaying       bool `yaml:"nowPlaying"`
 	Thumbs           bool `yaml:"thumbs"`
 	IgnoreThumbsDown bool `yaml:"ignoreThumbsDown"`
+	// IgnorePianobarErrors scrobbles tracks and sends feedback even if pianobar reports that its request failed
+	IgnorePianobarErrors bool `yaml:"ignorePianobarErrors"`
 
 	WALDirectory string `yaml:"wal"`
+	RejectedLog  string `yaml:"rejectedLog"`
+	DeadLetters  string `yaml:"deadLetters"`
+	Pending      string `yaml:"pending"`
+	PlayState    string `yaml:"playState"`
+
+	MaxAge  time.Duration `yaml:"maxAge"`
+	Backoff BackoffConfig `yaml:"backoff"`
+}
+
+// BackoffConfig controls how long to wait before retrying tracks that failed to scrobble
+type BackoffConfig struct {
+	Initial time.Duration `yaml:"initial"`
+	Max     time.Duration `yaml:"max"`
 }
 
 type EventConfig struct {
-	Next string `yaml:"next"`
+	// Budget is how long pianoman may spend handling each event before leaving the remaining work for later
+	Budget time.Duration `yaml:"budget"`
+	// Async queues requests to Last.FM and sends them from a background process, so pianobar doesn't wait for them
+	Async bool         `yaml:"async"`
+	Next  NextCommands `yaml:"next"`
+}
+
+// NextCommand is a program that eventcmd invocations are chained to
+type NextCommand struct {
+	Command string        `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+	Events  []string      `yaml:"events"`
+}
+
+// UnmarshalYAML allows a NextCommand to be specified as just the path to the program
+func (n *NextCommand) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&n.Command)
+	}
+
+	// Use a type alias to avoid recursing back into UnmarshalYAML
+	type plain NextCommand
+	return value.Decode((*plain)(n))
+}
+
+// NextCommands is a list of programs that eventcmd invocations are chained to. It may be
+// specified as a single program or as a list of programs.
+type NextCommands []NextCommand
+
+// UnmarshalYAML allows NextCommands to be specified as a single NextCommand or a list of them
+func (n *NextCommands) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode, yaml.MappingNode:
+		var single NextCommand
+		if err := value.Decode(&single); err != nil {
+			return err
+		}
+
+		*n = NextCommands{single}
+		return nil
+	case yaml.SequenceNode:
+		var many []NextCommand
+		if err := value.Decode(&many); err != nil {
+			return err
+		}
+
+		*n = many
+		return nil
+	default:
+		return fmt.Errorf("line %d: eventcmd.next must be a program or list of programs", value.Line)
+	}
+}
+
+type DaemonConfig struct {
+	Socket        string        `yaml:"socket"`
+	RetryInterval time.Duration `yaml:"retryInterval"`
+}
+
+// BreakerConfig controls when pianoman stops calling Last.FM because it is unreachable
+type BreakerConfig struct {
+	Threshold int           `yaml:"threshold"`
+	CoolOff   time.Duration `yaml:"coolOff"`
+}
+
+// HTTPConfig controls how requests are sent to Last.FM
+type HTTPConfig struct {
+	Timeout   time.Duration `yaml:"timeout"`
+	CABundle  string        `yaml:"caBundle"`
+	Proxy     string        `yaml:"proxy"`
+	UserAgent string        `yaml:"userAgent"`
 }
 
 var defaultConfig = Config{
@@ -52,8 +153,32 @@ var defaultConfig = Config{
 		Thumbs:           true,
 		IgnoreThumbsDown: true,
 		WALDirectory:     "wal",
+		RejectedLog:      "rejected.jsonl",
+		DeadLetters:      "deadletters.jsonl",
+		Pending:          "pending.jsonl",
+		PlayState:        "playing.json",
+		MaxAge:           14 * 24 * time.Hour,
+		Backoff: BackoffConfig{
+			Initial: time.Minute,
+			Max:     time.Hour,
+		},
+	},
+	EventCMD: EventConfig{
+		Budget: 15 * time.Second,
+	},
+	Daemon: DaemonConfig{
+		Socket:        "pianoman.sock",
+		RetryInterval: 5 * time.Minute,
+	},
+	Breaker: BreakerConfig{
+		Threshold: 3,
+		CoolOff:   5 * time.Minute,
+	},
+	HTTP: HTTPConfig{
+		Timeout: 10 * time.Second,
 	},
-	Verbosity: logrus.InfoLevel.String(),
+	LockTimeout: 10 * time.Second,
+	Verbosity:   logrus.InfoLevel.String(),
 }
 
 func Parse(r io.Reader) (Config, error) {
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_EventCMDNext(t *testing.T) {
+	t.Run("Single Program", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`eventcmd:
+  next: /opt/pianobar/notify.py`))
+		require.NoError(t, err)
+
+		assert.Equal(t, NextCommands{{Command: "/opt/pianobar/notify.py"}}, sut.EventCMD.Next)
+	})
+
+	t.Run("Single Program With Options", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`eventcmd:
+  next:
+    command: /opt/pianobar/notify.py
+    timeout: 5s
+    events: [songstart]`))
+		require.NoError(t, err)
+
+		assert.Equal(t, NextCommands{{
+			Command: "/opt/pianobar/notify.py",
+			Timeout: 5 * time.Second,
+			Events:  []string{"songstart"},
+		}}, sut.EventCMD.Next)
+	})
+
+	t.Run("Multiple Programs", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`eventcmd:
+  next:
+  - /opt/pianobar/notify.py
+  - command: /opt/pianobar/statusbar.sh
+    timeout: 1s`))
+		require.NoError(t, err)
+
+		assert.Equal(t, NextCommands{
+			{Command: "/opt/pianobar/notify.py"},
+			{Command: "/opt/pianobar/statusbar.sh", Timeout: time.Second},
+		}, sut.EventCMD.Next)
+	})
+}
+
+func TestParse_ScrobbleMaxAge(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`verbosity: info`))
+		require.NoError(t, err)
+
+		assert.Equal(t, 14*24*time.Hour, sut.Scrobble.MaxAge)
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`scrobble:
+  maxAge: 168h`))
+		require.NoError(t, err)
+
+		assert.Equal(t, 7*24*time.Hour, sut.Scrobble.MaxAge)
+	})
+}
+
+func TestParse_Budget(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`eventcmd:
+  next: /opt/pianobar/notify.py`))
+		require.NoError(t, err)
+
+		assert.Equal(t, 15*time.Second, sut.EventCMD.Budget)
+		assert.Equal(t, 10*time.Second, sut.HTTP.Timeout)
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		sut, err := Parse(strings.NewReader(`eventcmd:
+  budget: 5s
+http:
+  timeout: 3s
+  proxy: http://proxy.example.com:3128
+  userAgent: test/1.0`))
+		require.NoError(t, err)
+
+		assert.Equal(t, 5*time.Second, sut.EventCMD.Budget)
+		assert.Equal(t, HTTPConfig{Timeout: 3 * time.Second, Proxy: "http://proxy.example.com:3128", UserAgent: "test/1.0"}, sut.HTTP)
+	})
+}
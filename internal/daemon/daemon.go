@@ -0,0 +1,154 @@
+// Package daemon implements a simple protocol for forwarding eventcmd invocations to a long-running pianoman process
+// over a Unix socket. Each connection carries exactly one Request and one Response, encoded as JSON.
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("prefix", "daemon")
+
+// ErrNotRunning is returned by Forward if no daemon is listening on the socket
+var ErrNotRunning = errors.New("daemon is not running")
+
+// Request is sent to the daemon for each eventcmd invocation
+type Request struct {
+	Event   string `json:"event"`
+	Payload []byte `json:"payload"`
+}
+
+// Response is sent by the daemon once it has handled a Request
+type Response struct {
+	Error string `json:"error,omitempty"`
+}
+
+// HandlerFunc handles an event forwarded to the daemon
+type HandlerFunc func(ctx context.Context, event string, payload io.Reader) error
+
+// Forward sends the specified event and payload to the daemon listening at socket, and waits for it to be handled.
+// If no daemon is listening, an error wrapping ErrNotRunning is returned and the event was not handled.
+func Forward(ctx context.Context, socket, event string, payload []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return fmt.Errorf("forward: %w: %w", ErrNotRunning, err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Don't wait forever if we're cancelled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	log.Debugf("Forwarding %s to daemon at %s", event, socket)
+	if err = json.NewEncoder(conn).Encode(Request{Event: event, Payload: payload}); err != nil {
+		return fmt.Errorf("forward: failed to send request: %w", err)
+	}
+
+	var resp Response
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("forward: failed to read response: %w", err)
+	}
+
+	if resp.Error != "" {
+		return fmt.Errorf("daemon: %s", resp.Error)
+	}
+
+	return nil
+}
+
+// Listen creates a Unix socket at the specified path that only the current user may connect to. If a stale socket
+// exists from a daemon that is no longer running, it is removed. If another daemon is listening on the socket, an
+// error is returned.
+func Listen(socket string) (net.Listener, error) {
+	if _, err := os.Stat(socket); err == nil {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("listen: another daemon is already listening on %s", socket)
+		}
+
+		log.Debugf("Removing stale socket %s", socket)
+		if err = os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("listen: failed to remove stale socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	if err = os.Chmod(socket, 0o600); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("listen: failed to secure socket: %w", err)
+	}
+
+	return l, nil
+}
+
+// Serve accepts connections on l and handles the request from each one with h until the provided context is
+// cancelled. Requests may be handled concurrently, h must synchronize access to any shared state. Once the context is
+// cancelled, the listener is closed and Serve waits for any in-flight requests to finish.
+func Serve(ctx context.Context, l net.Listener, h HandlerFunc) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = l.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	log.Infof("Listening on %s", l.Addr().String())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("serve: failed to accept connection: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveConn(ctx, conn, h)
+		}()
+	}
+}
+
+func serveConn(ctx context.Context, conn net.Conn, h HandlerFunc) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.WithError(err).Warn("Failed to read request")
+		return
+	}
+
+	var resp Response
+	if err := h(ctx, req.Event, bytes.NewReader(req.Payload)); err != nil {
+		log.WithError(err).Warnf("Failed to handle %s", req.Event)
+		resp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.WithError(err).Warn("Failed to send response")
+	}
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, h HandlerFunc) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "pianoman.sock")
+	l, err := Listen(socket)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ctx, l, h)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return socket
+}
+
+func TestForward(t *testing.T) {
+	t.Run("Not Running", func(t *testing.T) {
+		err := Forward(context.Background(), filepath.Join(t.TempDir(), "pianoman.sock"), "songstart", nil)
+
+		require.ErrorIs(t, err, ErrNotRunning)
+	})
+
+	t.Run("OK", func(t *testing.T) {
+		var gotEvent, gotPayload string
+		socket := serve(t, func(_ context.Context, event string, payload io.Reader) error {
+			v, err := io.ReadAll(payload)
+			require.NoError(t, err)
+
+			gotEvent = event
+			gotPayload = string(v)
+			return nil
+		})
+
+		require.NoError(t, Forward(context.Background(), socket, "songstart", []byte("artist=Test Artist")))
+
+		assert.Equal(t, "songstart", gotEvent)
+		assert.Equal(t, "artist=Test Artist", gotPayload)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		socket := serve(t, func(_ context.Context, _ string, _ io.Reader) error {
+			return fmt.Errorf("dummy")
+		})
+
+		err := Forward(context.Background(), socket, "songstart", nil)
+		require.EqualError(t, err, "daemon: dummy")
+		require.NotErrorIs(t, err, ErrNotRunning)
+	})
+}
+
+func TestListen(t *testing.T) {
+	t.Run("Already Running", func(t *testing.T) {
+		socket := serve(t, func(_ context.Context, _ string, _ io.Reader) error {
+			return nil
+		})
+
+		_, err := Listen(socket)
+		require.ErrorContains(t, err, "another daemon is already listening")
+	})
+
+	t.Run("Stale Socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "pianoman.sock")
+
+		l, err := Listen(socket)
+		require.NoError(t, err)
+
+		// Leave the socket file behind like a daemon that crashed would
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		require.NoError(t, l.Close())
+		require.FileExists(t, socket)
+
+		l, err = Listen(socket)
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+	})
+}
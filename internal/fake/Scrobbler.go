@@ -5,6 +5,7 @@ package fake
 import (
 	context "context"
 
+	lastfm "github.com/nlowe/pianoman/lastfm"
 	mock "github.com/stretchr/testify/mock"
 
 	pianobar "github.com/nlowe/pianoman/pianobar"
@@ -24,7 +25,7 @@ func (_m *Scrobbler) EXPECT() *Scrobbler_Expecter {
 }
 
 // Scrobble provides a mock function with given fields: ctx, t
-func (_m *Scrobbler) Scrobble(ctx context.Context, t ...pianobar.Track) error {
+func (_m *Scrobbler) Scrobble(ctx context.Context, t ...pianobar.Track) (lastfm.ScrobbleResult, error) {
 	_va := make([]interface{}, len(t))
 	for _i := range t {
 		_va[_i] = t[_i]
@@ -38,14 +39,24 @@ func (_m *Scrobbler) Scrobble(ctx context.Context, t ...pianobar.Track) error {
 		panic("no return value specified for Scrobble")
 	}
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, ...pianobar.Track) error); ok {
+	var r0 lastfm.ScrobbleResult
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, ...pianobar.Track) (lastfm.ScrobbleResult, error)); ok {
+		return rf(ctx, t...)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, ...pianobar.Track) lastfm.ScrobbleResult); ok {
 		r0 = rf(ctx, t...)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(lastfm.ScrobbleResult)
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(context.Context, ...pianobar.Track) error); ok {
+		r1 = rf(ctx, t...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // Scrobbler_Scrobble_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Scrobble'
@@ -74,12 +85,12 @@ func (_c *Scrobbler_Scrobble_Call) Run(run func(ctx context.Context, t ...pianob
 	return _c
 }
 
-func (_c *Scrobbler_Scrobble_Call) Return(_a0 error) *Scrobbler_Scrobble_Call {
-	_c.Call.Return(_a0)
+func (_c *Scrobbler_Scrobble_Call) Return(_a0 lastfm.ScrobbleResult, _a1 error) *Scrobbler_Scrobble_Call {
+	_c.Call.Return(_a0, _a1)
 	return _c
 }
 
-func (_c *Scrobbler_Scrobble_Call) RunAndReturn(run func(context.Context, ...pianobar.Track) error) *Scrobbler_Scrobble_Call {
+func (_c *Scrobbler_Scrobble_Call) RunAndReturn(run func(context.Context, ...pianobar.Track) (lastfm.ScrobbleResult, error)) *Scrobbler_Scrobble_Call {
 	_c.Call.Return(run)
 	return _c
 }
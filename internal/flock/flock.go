@@ -0,0 +1,62 @@
+// Package flock provides advisory, cross-process file locks
+package flock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// pollInterval is how often Acquire checks if a held lock has been released
+const pollInterval = 25 * time.Millisecond
+
+// ErrLocked is returned when a lock is held by another process
+var ErrLocked = errors.New("locked by another process")
+
+// Lock is an exclusive advisory lock on a file
+type Lock struct {
+	f *os.File
+}
+
+// TryAcquire takes an exclusive lock on the file at path, creating it if required. If another process holds the
+// lock, an error wrapping ErrLocked is returned immediately.
+func TryAcquire(path string) (*Lock, error) {
+	return Acquire(context.Background(), path, 0)
+}
+
+// Acquire takes an exclusive lock on the file at path, creating it if required. If another process holds the lock,
+// Acquire waits up to timeout for it to be released before returning an error wrapping ErrLocked. If ctx is done
+// first, an error wrapping ctx's error is returned instead.
+func Acquire(ctx context.Context, path string, timeout time.Duration) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = tryLock(f)
+		if err == nil {
+			return &Lock{f: f}, nil
+		}
+
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			_ = f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Release releases the lock
+func (l *Lock) Release() error {
+	return errors.Join(unlock(l.f), l.f.Close())
+}
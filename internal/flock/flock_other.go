@@ -0,0 +1,15 @@
+//go:build !unix
+
+package flock
+
+import "os"
+
+// Advisory locks are not supported on this platform, so locks are always acquired
+
+func tryLock(_ *os.File) error {
+	return nil
+}
+
+func unlock(_ *os.File) error {
+	return nil
+}
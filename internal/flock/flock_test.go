@@ -0,0 +1,48 @@
+package flock
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "lock")
+
+	sut, err := TryAcquire(p)
+	require.NoError(t, err)
+
+	_, err = TryAcquire(p)
+	require.ErrorIs(t, err, ErrLocked)
+
+	start := time.Now()
+	_, err = Acquire(context.Background(), p, 100*time.Millisecond)
+	require.ErrorIs(t, err, ErrLocked)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond, "should have waited for the lock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	_, err = Acquire(ctx, p, time.Minute)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "should have stopped waiting when the context was done")
+
+	// Release the lock while another caller is waiting for it
+	released := make(chan struct{})
+	go func(l *Lock) {
+		defer close(released)
+
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, l.Release())
+	}(sut)
+
+	next, err := Acquire(context.Background(), p, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, next.Release())
+	<-released
+}
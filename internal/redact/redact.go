@@ -0,0 +1,88 @@
+// Package redact provides a logrus hook that prevents secrets such as passwords, session keys, API secrets and
+// request signatures from being logged.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secrets in log entries
+const Redacted = "[REDACTED]"
+
+// sensitiveParams matches key=value pairs for parameters that are always secret, regardless of their value
+var sensitiveParams = regexp.MustCompile(`(?i)\b(password|sk|api_sig|api_secret|secret)=([^&\s]+)`)
+
+// Hook is a logrus.Hook that redacts secrets from log messages and fields
+type Hook struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+var _ logrus.Hook = (*Hook)(nil)
+
+var std = &Hook{}
+
+// Std returns the Hook that secrets are registered to with Add
+func Std() *Hook {
+	return std
+}
+
+// Add registers secrets that should be redacted by the standard Hook
+func Add(secrets ...string) {
+	std.Add(secrets...)
+}
+
+// Add registers secrets that should be redacted by the Hook. Empty and previously registered secrets are ignored.
+func (h *Hook) Add(secrets ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range secrets {
+		if strings.TrimSpace(s) == "" || slices.Contains(h.secrets, s) {
+			continue
+		}
+
+		h.secrets = append(h.secrets, s)
+	}
+}
+
+// Redact replaces any registered secrets and the values of sensitive parameters in v
+func (h *Hook) Redact(v string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, s := range h.secrets {
+		v = strings.ReplaceAll(v, s, Redacted)
+	}
+
+	return sensitiveParams.ReplaceAllString(v, "${1}="+Redacted)
+}
+
+// Levels implements logrus.Hook. Secrets are redacted at all levels.
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook. It redacts the message and any string, error, or fmt.Stringer fields of the entry.
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.Redact(entry.Message)
+
+	for k, v := range entry.Data {
+		switch vt := v.(type) {
+		case string:
+			entry.Data[k] = h.Redact(vt)
+		case error:
+			entry.Data[k] = h.Redact(vt.Error())
+		case fmt.Stringer:
+			entry.Data[k] = h.Redact(vt.String())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHook_Redact(t *testing.T) {
+	sut := &Hook{}
+	sut.Add("hunter2", "", "  ")
+
+	for _, tt := range []struct {
+		name     string
+		in       string
+		expected string
+	}{
+		{name: "Secret", in: "my password is hunter2", expected: "my password is [REDACTED]"},
+		{name: "Params", in: "api_key=123&api_sig=abc&method=foo&sk=def", expected: "api_key=123&api_sig=[REDACTED]&method=foo&sk=[REDACTED]"},
+		{name: "Password Param", in: "username=nlowe password=letmein", expected: "username=nlowe password=[REDACTED]"},
+		{name: "Unrelated", in: "artist=The Score", expected: "artist=The Score"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, sut.Redact(tt.in))
+		})
+	}
+}
+
+func TestHook_Fire(t *testing.T) {
+	sut := &Hook{}
+	sut.Add("hunter2")
+
+	buf := &bytes.Buffer{}
+	l := logrus.New()
+	l.SetOutput(buf)
+	l.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true, DisableQuote: true})
+	l.AddHook(sut)
+
+	l.WithError(fmt.Errorf("bad password hunter2")).WithField("sk", "hunter2").Warn("logging in with hunter2")
+
+	assert.NotContains(t, buf.String(), "hunter2")
+	assert.Equal(
+		t,
+		"level=warning msg=logging in with [REDACTED] error=bad password [REDACTED] sk=[REDACTED]\n",
+		buf.String(),
+	)
+}
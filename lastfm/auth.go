@@ -0,0 +1,77 @@
+package lastfm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nlowe/pianoman/internal/redact"
+)
+
+const (
+	authRoot = "https://www.last.fm/api/auth/"
+
+	// https://www.last.fm/api/desktopauth
+	// https://www.last.fm/api/show/auth.getToken
+	methodGetToken = "auth.getToken"
+	// https://www.last.fm/api/show/auth.getSession
+	methodGetSession = "auth.getSession"
+
+	paramToken = "token"
+)
+
+// GetToken fetches a request token for the desktop authentication flow. The user must approve the token by visiting
+// AuthURL before it can be exchanged for a session with GetSession.
+func (a *API) GetToken(ctx context.Context) (string, error) {
+	log.Debug("Requesting auth token")
+
+	resp, err := sendAndCheck[string](ctx, a, newRequest(methodGetToken))
+	if err != nil {
+		return "", fmt.Errorf("get token: %w", err)
+	}
+
+	return resp.Value, nil
+}
+
+// AuthURL returns the URL the user must visit to approve the specified token
+func (a *API) AuthURL(token string) string {
+	return authRoot + "?" + url.Values{paramApiKey: {a.apiKey}, paramToken: {token}}.Encode()
+}
+
+// GetSession exchanges an approved token for a session
+func (a *API) GetSession(ctx context.Context, token string) (Session, error) {
+	params := newRequest(methodGetSession)
+	params.set(paramToken, token)
+
+	resp, err := sendAndCheck[Session](ctx, a, params)
+	if err != nil {
+		return Session{}, fmt.Errorf("get session: %w", err)
+	}
+
+	redact.Add(resp.Value.Key)
+	return resp.Value, nil
+}
+
+// WaitForSession polls GetSession on the specified interval until the user approves the token, the token expires,
+// or the provided context is cancelled.
+func (a *API) WaitForSession(ctx context.Context, token string, interval time.Duration) (Session, error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		session, err := a.GetSession(ctx, token)
+
+		// auth.getSession fails with ErrCodeUnauthorizedToken until the user approves the token
+		if c, ok := code(err); !ok || c != ErrCodeUnauthorizedToken {
+			return session, err
+		}
+
+		log.Trace("Token has not been approved yet")
+		select {
+		case <-ctx.Done():
+			return Session{}, fmt.Errorf("wait for session: %w", ctx.Err())
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package lastfm
+
+import (
+	"context"
+
+	"github.com/nlowe/pianoman/internal/breaker"
+	"github.com/nlowe/pianoman/pianobar"
+)
+
+// Guarded wraps a Scrobbler and FeedbackProvider with a circuit breaker. Once Last.FM has been unreachable for too
+// many consecutive requests, requests fail with an error wrapping breaker.ErrOpen without being sent.
+type Guarded struct {
+	s Scrobbler
+	f FeedbackProvider
+	b *breaker.Breaker
+}
+
+// Ensure Guarded implements Scrobbler and FeedbackProvider
+var _ Scrobbler = (*Guarded)(nil)
+var _ FeedbackProvider = (*Guarded)(nil)
+
+// NewGuarded wraps the specified Scrobbler and FeedbackProvider with the specified circuit breaker. The breaker should
+// count errors for which IsUnreachable returns true as failures.
+func NewGuarded(s Scrobbler, f FeedbackProvider, b *breaker.Breaker) *Guarded {
+	return &Guarded{s: s, f: f, b: b}
+}
+
+// Scrobble calls Scrobble on the wrapped Scrobbler unless the circuit is open
+func (g *Guarded) Scrobble(ctx context.Context, t ...pianobar.Track) (ScrobbleResult, error) {
+	var result ScrobbleResult
+	err := g.b.Do(ctx, func() error {
+		var err error
+		result, err = g.s.Scrobble(ctx, t...)
+		return err
+	})
+
+	return result, err
+}
+
+// UpdateNowPlaying calls UpdateNowPlaying on the wrapped Scrobbler unless the circuit is open
+func (g *Guarded) UpdateNowPlaying(ctx context.Context, t pianobar.Track) error {
+	return g.b.Do(ctx, func() error {
+		return g.s.UpdateNowPlaying(ctx, t)
+	})
+}
+
+// LoveTrack calls LoveTrack on the wrapped FeedbackProvider unless the circuit is open
+func (g *Guarded) LoveTrack(ctx context.Context, t pianobar.Track) error {
+	return g.b.Do(ctx, func() error {
+		return g.f.LoveTrack(ctx, t)
+	})
+}
+
+// UnLoveTrack calls UnLoveTrack on the wrapped FeedbackProvider unless the circuit is open
+func (g *Guarded) UnLoveTrack(ctx context.Context, t pianobar.Track) error {
+	return g.b.Do(ctx, func() error {
+		return g.f.UnLoveTrack(ctx, t)
+	})
+}
@@ -0,0 +1,142 @@
+package lastfm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Error codes returned by the Last.FM API. See https://www.last.fm/api/errorcodes
+const (
+	ErrCodeInvalidService         = 2
+	ErrCodeInvalidMethod          = 3
+	ErrCodeAuthenticationFailed   = 4
+	ErrCodeInvalidFormat          = 5
+	ErrCodeInvalidParameters      = 6
+	ErrCodeInvalidResource        = 7
+	ErrCodeOperationFailed        = 8
+	ErrCodeInvalidSessionKey      = 9
+	ErrCodeInvalidAPIKey          = 10
+	ErrCodeServiceOffline         = 11
+	ErrCodeInvalidMethodSignature = 13
+	ErrCodeUnauthorizedToken      = 14
+	ErrCodeTokenExpired           = 15
+	ErrCodeTemporarilyUnavailable = 16
+	ErrCodeSuspendedAPIKey        = 26
+	ErrCodeRateLimitExceeded      = 29
+)
+
+var (
+	// retryableCodes are the error codes that the Last.FM documentation says should be retried later
+	retryableCodes = []int{
+		ErrCodeOperationFailed,
+		ErrCodeInvalidSessionKey,
+		ErrCodeServiceOffline,
+		ErrCodeTemporarilyUnavailable,
+		ErrCodeRateLimitExceeded,
+	}
+
+	// authCodes are the error codes that indicate a problem with our credentials or session
+	authCodes = []int{
+		ErrCodeAuthenticationFailed,
+		ErrCodeInvalidSessionKey,
+		ErrCodeInvalidAPIKey,
+		ErrCodeInvalidMethodSignature,
+		ErrCodeUnauthorizedToken,
+		ErrCodeTokenExpired,
+		ErrCodeSuspendedAPIKey,
+	}
+
+	// sessionCodes are the auth error codes that mean the session key itself is no longer valid
+	sessionCodes = []int{
+		ErrCodeInvalidSessionKey,
+		ErrCodeUnauthorizedToken,
+		ErrCodeTokenExpired,
+	}
+)
+
+// ErrNotLoggedIn is returned when there is no cached session and no password to log in with
+var ErrNotLoggedIn = errors.New("not logged in to Last.FM: run 'pianoman auth login' or configure auth.user.password")
+
+// SessionError is returned when a session could not be acquired. The request that required the session was never
+// sent to Last.FM.
+type SessionError struct {
+	Err error
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("failed to login to Last.FM: %v", e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// code returns the Last.FM error code from err, if any
+func code(err error) (int, bool) {
+	lfm := &Error{}
+	if errors.As(err, &lfm) {
+		return lfm.Code, true
+	}
+
+	return 0, false
+}
+
+// IsRetryable returns true iff the request that caused err should be retried later. Errors returned by Last.FM are
+// only retried if the Last.FM documentation says they should be. Any other errors (i.e. from the network stack or
+// failing to acquire a session) mean Last.FM never processed the request, so they are always retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var sessionErr *SessionError
+	if errors.As(err, &sessionErr) {
+		return true
+	}
+
+	if c, ok := code(err); ok {
+		return slices.Contains(retryableCodes, c)
+	}
+
+	return true
+}
+
+// IsAuthError returns true iff err was caused by a problem with our credentials or session
+func IsAuthError(err error) bool {
+	if errors.Is(err, ErrNotLoggedIn) {
+		return true
+	}
+
+	c, ok := code(err)
+	return ok && slices.Contains(authCodes, c)
+}
+
+// IsSessionExpired returns true iff err means the session key is no longer valid, so the user has to login again. Other
+// auth errors (i.e. an invalid API key) don't say anything about the session.
+func IsSessionExpired(err error) bool {
+	c, ok := code(err)
+	return ok && slices.Contains(sessionCodes, c)
+}
+
+// IsRateLimited returns true iff err was caused by exceeding the Last.FM rate limit
+func IsRateLimited(err error) bool {
+	c, ok := code(err)
+	return ok && c == ErrCodeRateLimitExceeded
+}
+
+// IsUnreachable returns true iff err means Last.FM could not be reached or is down. Errors from the network stack and
+// responses that could not be parsed (i.e. from a proxy or load balancer) mean Last.FM never answered the request, as
+// do the error codes Last.FM uses when the service is offline.
+func IsUnreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrNotLoggedIn) {
+		return false
+	}
+
+	if c, ok := code(err); ok {
+		return c == ErrCodeServiceOffline || c == ErrCodeTemporarilyUnavailable
+	}
+
+	return true
+}
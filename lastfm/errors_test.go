@@ -0,0 +1,44 @@
+package lastfm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorPredicates(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		err         error
+		retryable   bool
+		auth        bool
+		expired     bool
+		rateLimited bool
+		unreachable bool
+	}{
+		{name: "nil"},
+		{name: "Network", err: fmt.Errorf("dial tcp: connection refused"), retryable: true, unreachable: true},
+		{name: "Cancelled", err: fmt.Errorf("wrapped: %w", context.Canceled), retryable: true},
+		{name: "Not Logged In", err: &SessionError{Err: ErrNotLoggedIn}, retryable: true, auth: true},
+		{name: "Login Failed", err: &SessionError{Err: &Error{Code: ErrCodeAuthenticationFailed}}, retryable: true, auth: true},
+		{name: "Login Unreachable", err: &SessionError{Err: fmt.Errorf("dial tcp: i/o timeout")}, retryable: true, unreachable: true},
+		{name: "Invalid Parameters", err: &Error{Code: ErrCodeInvalidParameters}},
+		{name: "Operation Failed", err: &Error{Code: ErrCodeOperationFailed}, retryable: true},
+		{name: "Invalid Session Key", err: &Error{Code: ErrCodeInvalidSessionKey}, retryable: true, auth: true, expired: true},
+		{name: "Invalid API Key", err: &Error{Code: ErrCodeInvalidAPIKey}, auth: true},
+		{name: "Token Expired", err: &SessionError{Err: &Error{Code: ErrCodeTokenExpired}}, retryable: true, auth: true, expired: true},
+		{name: "Service Offline", err: &Error{Code: ErrCodeServiceOffline}, retryable: true, unreachable: true},
+		{name: "Temporarily Unavailable", err: &Error{Code: ErrCodeTemporarilyUnavailable}, retryable: true, unreachable: true},
+		{name: "Rate Limit Exceeded", err: fmt.Errorf("wrapped: %w", &Error{Code: ErrCodeRateLimitExceeded}), retryable: true, rateLimited: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.retryable, IsRetryable(tt.err), "IsRetryable")
+			assert.Equal(t, tt.auth, IsAuthError(tt.err), "IsAuthError")
+			assert.Equal(t, tt.expired, IsSessionExpired(tt.err), "IsSessionExpired")
+			assert.Equal(t, tt.rateLimited, IsRateLimited(tt.err), "IsRateLimited")
+			assert.Equal(t, tt.unreachable, IsUnreachable(tt.err), "IsUnreachable")
+		})
+	}
+}
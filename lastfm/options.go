@@ -0,0 +1,65 @@
+package lastfm
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// DefaultUserAgent is the User-Agent sent to Last.FM by default
+const DefaultUserAgent = "pianoman (+https://github.com/nlowe/pianoman)"
+
+type options struct {
+	client         *http.Client
+	userAgent      string
+	requestTimeout time.Duration
+
+	onSessionExpired func()
+}
+
+func defaultOptions() options {
+	return options{
+		client:    cleanhttp.DefaultClient(),
+		userAgent: DefaultUserAgent,
+
+		onSessionExpired: func() {},
+	}
+}
+
+// Option configures optional behavior of an API client
+type Option func(o *options)
+
+// WithHTTPClient sets the HTTP client used to send requests to Last.FM
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithUserAgent sets the User-Agent sent with each request. If empty, DefaultUserAgent is used.
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		if ua == "" {
+			ua = DefaultUserAgent
+		}
+
+		o.userAgent = ua
+	}
+}
+
+// WithRequestTimeout sets how long to wait for each request to Last.FM, including reading the response. By default, or
+// with a timeout of zero, requests only time out when their context is cancelled.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.requestTimeout = d
+	}
+}
+
+// WithSessionExpired sets a function to call when Last.FM reports that the session is no longer valid, for example to
+// forget a cached session
+func WithSessionExpired(fn func()) Option {
+	return func(o *options) {
+		o.onSessionExpired = fn
+	}
+}
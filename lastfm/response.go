@@ -42,7 +42,50 @@ type Track struct {
 	AlbumArtist String `xml:"albumArtist,omitempty"`
 	Timestamp   int    `xml:"timestamp"`
 
-	IgnoreReason String `xml:"ignoreMessage,omitempty"`
+	IgnoreReason IgnoredMessage `xml:"ignoredMessage,omitempty"`
+}
+
+// Ignored returns true iff Last.FM ignored the scrobble
+func (t Track) Ignored() bool {
+	return t.IgnoreReason.Code != IgnoredCodeNone
+}
+
+// Codes Last.FM uses to describe why a scrobble was ignored, see https://www.last.fm/api/scrobbling#ignored-scrobbles
+const (
+	IgnoredCodeNone = iota
+	IgnoredCodeArtist
+	IgnoredCodeTrack
+	IgnoredCodeTimestampTooOld
+	IgnoredCodeTimestampTooNew
+	IgnoredCodeDailyLimitExceeded
+)
+
+type IgnoredMessage struct {
+	Code    int    `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+func (m IgnoredMessage) String() string {
+	if m.Message != "" {
+		return m.Message
+	}
+
+	switch m.Code {
+	case IgnoredCodeNone:
+		return ""
+	case IgnoredCodeArtist:
+		return "Artist was ignored"
+	case IgnoredCodeTrack:
+		return "Track was ignored"
+	case IgnoredCodeTimestampTooOld:
+		return "Timestamp was too old"
+	case IgnoredCodeTimestampTooNew:
+		return "Timestamp was too new"
+	case IgnoredCodeDailyLimitExceeded:
+		return "Daily scrobble limit exceeded"
+	default:
+		return fmt.Sprintf("Ignored with code %d", m.Code)
+	}
 }
 
 type Session struct {
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/hashicorp/go-cleanhttp"
 	"github.com/sirupsen/logrus"
 
+	"github.com/nlowe/pianoman/internal/redact"
 	"github.com/nlowe/pianoman/lazy"
 
 	"github.com/nlowe/pianoman/pianobar"
@@ -52,7 +54,10 @@ type Scrobbler interface {
 	// queued for a single request. If the provided context is cancelled before the request can be made to Last.FM's API
 	// it will be retried on the next request. If it is cancelled after the request has been sent but before the
 	// response can be read, it will not be retried later.
-	Scrobble(ctx context.Context, t ...pianobar.Track) error
+	//
+	// If the request succeeds, the result describes whether each track was accepted or ignored, in the order the tracks
+	// were provided.
+	Scrobble(ctx context.Context, t ...pianobar.Track) (ScrobbleResult, error)
 
 	// UpdateNowPlaying submits the specified track to Last.FM's track.updateNowPlaying API
 	UpdateNowPlaying(ctx context.Context, t pianobar.Track) error
@@ -67,7 +72,11 @@ type FeedbackProvider interface {
 }
 
 type API struct {
-	api *http.Client
+	api            *http.Client
+	userAgent      string
+	requestTimeout time.Duration
+
+	onSessionExpired func()
 
 	sessionKeyCache *lazy.Value[string]
 	sessionKey      string
@@ -82,9 +91,18 @@ type API struct {
 var _ Scrobbler = (*API)(nil)
 var _ FeedbackProvider = (*API)(nil)
 
-func New(cache *lazy.Value[string], key, secret, username, password string) *API {
+func New(cache *lazy.Value[string], key, secret, username, password string, opts ...Option) *API {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return &API{
-		api: cleanhttp.DefaultClient(),
+		api:            o.client,
+		userAgent:      o.userAgent,
+		requestTimeout: o.requestTimeout,
+
+		onSessionExpired: o.onSessionExpired,
 
 		sessionKeyCache: cache,
 
@@ -102,19 +120,32 @@ func sendAndCheck[TResult any](ctx context.Context, a *API, params Request) (Res
 	log.Debugf("Signing %s request", params.method())
 	params.sign(a.apiKey, a.apiSecret, a.sessionKey)
 
-	// Send the request
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiRoot, nil)
+	if a.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.requestTimeout)
+		defer cancel()
+	}
+
+	// Send the request. Parameters are sent in the body so secrets don't end up in URLs
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiRoot, strings.NewReader(params.encode()))
 	if err != nil {
 		return result, fmt.Errorf("sendAndCheck: failed to build request: %w", err)
 	}
 
-	req.URL.RawQuery = params.encode()
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if a.userAgent != "" {
+		req.Header.Set("User-Agent", a.userAgent)
+	}
 
 	resp, err := a.api.Do(req)
 	if err != nil {
 		return result, fmt.Errorf("sendAndCheck: failed to make request: %w", err)
 	}
 
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
 	// Zero the session on common http auth failure codes
 	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
 		a.sessionKeyCache.Zero()
@@ -126,9 +157,14 @@ func sendAndCheck[TResult any](ctx context.Context, a *API, params Request) (Res
 		return result, fmt.Errorf("sendAndCheck: request failed: failed to parse response: %s: %w", resp.Status, err)
 	}
 
-	// If we get any error, expire the session so we get a fresh one next time
-	if result.Error != nil {
+	// If our credentials or session were rejected, expire the session so we get a fresh one next time. Other errors
+	// (i.e. a track Last.FM didn't like) don't mean anything is wrong with the session.
+	if result.Error != nil && IsAuthError(result.Error) {
 		a.sessionKeyCache.Zero()
+
+		if IsSessionExpired(result.Error) && a.onSessionExpired != nil {
+			a.onSessionExpired()
+		}
 	}
 
 	// Check Response
@@ -144,9 +180,13 @@ func sendAndCheck[TResult any](ctx context.Context, a *API, params Request) (Res
 	return result, nil
 }
 
-func (a *API) ensureSessionKey(ctx context.Context) {
-	a.sessionKey = a.sessionKeyCache.Fetch(func() string {
-		log.Debugf("Logging into Last.FM as %s", a.username)
+func (a *API) ensureSessionKey(ctx context.Context) error {
+	key, err := a.sessionKeyCache.TryFetch(func() (string, error) {
+		if a.password == "" {
+			return "", ErrNotLoggedIn
+		}
+
+		log.Debug("Logging into Last.FM")
 		params := newRequest(methodGetMobileSession)
 		params.set(paramApiKey, a.apiKey)
 		params.set("username", a.username)
@@ -154,47 +194,86 @@ func (a *API) ensureSessionKey(ctx context.Context) {
 
 		resp, err := sendAndCheck[Session](ctx, a, params)
 		if err != nil {
-			log.WithError(err).Fatal("Failed to login to Last.FM")
+			return "", err
 		}
 
-		return resp.Value.Key
+		redact.Add(resp.Value.Key)
+		return resp.Value.Key, nil
 	})
+
+	if err != nil {
+		return &SessionError{Err: err}
+	}
+
+	a.sessionKey = key
+	return nil
 }
 
 // Scrobble sends the provided track and all other pending scrobbles to https://www.last.fm/api/show/track.scrobble
-func (a *API) Scrobble(ctx context.Context, tracks ...pianobar.Track) error {
+func (a *API) Scrobble(ctx context.Context, tracks ...pianobar.Track) (ScrobbleResult, error) {
 	if len(tracks) == 0 {
-		return fmt.Errorf("scrobble: must provide at least one track")
+		return ScrobbleResult{}, fmt.Errorf("scrobble: must provide at least one track")
 	}
 
 	if len(tracks) > MaxTracksPerScrobble {
-		return fmt.Errorf("scrobble: up to %d tracks may be included in one scrobble request: got %d", MaxTracksPerScrobble, len(tracks))
+		return ScrobbleResult{}, fmt.Errorf("scrobble: up to %d tracks may be included in one scrobble request: got %d", MaxTracksPerScrobble, len(tracks))
 	}
 
-	a.ensureSessionKey(ctx)
+	if err := a.ensureSessionKey(ctx); err != nil {
+		return ScrobbleResult{}, err
+	}
 
 	log.Debugf("Scrobbling %d track(s)", len(tracks))
 
 	// Populate Tracks
 	params := newRequest(methodScrobble)
+	timestamps := uniqueTimestamps(tracks)
 	for i, t := range tracks {
 		params.set(fmt.Sprintf("artist[%d]", i), t.Artist)
 		params.set(fmt.Sprintf("track[%d]", i), t.Title)
-		params.set(fmt.Sprintf("timestamp[%d]", i), strconv.Itoa(int(t.ScrobbleAt.Unix())))
+		params.set(fmt.Sprintf("timestamp[%d]", i), strconv.FormatInt(timestamps[i], 10))
 		params.set(fmt.Sprintf("album[%d]", i), t.Album)
 		params.set(fmt.Sprintf("chosenByUser[%d]", i), "0")
 		params.set(fmt.Sprintf("duration[%d]", i), strconv.Itoa(int(t.SongDuration.Seconds())))
 	}
 
 	resp, err := sendAndCheck[ScrobbleResult](ctx, a, params)
-	log.Tracef("Last.FM accepted %d track(s) and ignored %d track(s)", resp.Value.Accepted, resp.Value.Ignored)
+	if err != nil {
+		return ScrobbleResult{}, err
+	}
 
-	return err
+	log.Debugf("Last.FM accepted %d track(s) and ignored %d track(s)", resp.Value.Accepted, resp.Value.Ignored)
+	return resp.Value, nil
+}
+
+// uniqueTimestamps returns the unix timestamp to scrobble each track at. Last.FM treats scrobbles with the same
+// timestamp as duplicates, so tracks that would share a timestamp with an earlier track in the batch are moved later
+// by a second at a time until they don't.
+func uniqueTimestamps(tracks []pianobar.Track) []int64 {
+	result := make([]int64, len(tracks))
+	seen := make(map[int64]struct{}, len(tracks))
+	for i, t := range tracks {
+		ts := t.ScrobbleAt.Unix()
+		for {
+			if _, ok := seen[ts]; !ok {
+				break
+			}
+
+			ts++
+		}
+
+		seen[ts] = struct{}{}
+		result[i] = ts
+	}
+
+	return result
 }
 
 // UpdateNowPlaying calls https://www.last.fm/api/show/track.updateNowPlaying
 func (a *API) UpdateNowPlaying(ctx context.Context, t pianobar.Track) error {
-	a.ensureSessionKey(ctx)
+	if err := a.ensureSessionKey(ctx); err != nil {
+		return err
+	}
 
 	log.Debugf("Updating now-playing: %+v", t)
 
@@ -212,7 +291,9 @@ func (a *API) UpdateNowPlaying(ctx context.Context, t pianobar.Track) error {
 
 // LoveTrack calls https://www.last.fm/api/show/track.love
 func (a *API) LoveTrack(ctx context.Context, t pianobar.Track) error {
-	a.ensureSessionKey(ctx)
+	if err := a.ensureSessionKey(ctx); err != nil {
+		return err
+	}
 
 	log.Debugf("Loving Track: %+v", t)
 	params := newRequest(methodLoveTrack)
@@ -226,7 +307,9 @@ func (a *API) LoveTrack(ctx context.Context, t pianobar.Track) error {
 
 // UnLoveTrack calls https://www.last.fm/api/show/track.unlove
 func (a *API) UnLoveTrack(ctx context.Context, t pianobar.Track) error {
-	a.ensureSessionKey(ctx)
+	if err := a.ensureSessionKey(ctx); err != nil {
+		return err
+	}
 
 	log.Debugf("Un-Loving Track: %+v", t)
 
@@ -2,6 +2,7 @@ package lastfm
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"maps"
 	"net/http"
@@ -56,6 +57,18 @@ func setupAPI(t *testing.T, f func(r *http.Request) *http.Response) *API {
 	}
 }
 
+// requestParams returns the form-encoded parameters sent in the body of the request
+func requestParams(t *testing.T, r *http.Request) url.Values {
+	t.Helper()
+
+	assert.Equal(t, http.MethodPost, r.Method)
+	assert.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+	assert.Empty(t, r.URL.RawQuery, "parameters should not be sent in the URL")
+
+	require.NoError(t, r.ParseForm())
+	return r.PostForm
+}
+
 func assertHasParam(t *testing.T, params url.Values, k, v string) {
 	t.Helper()
 
@@ -85,11 +98,8 @@ func TestAPI_Scrobble(t *testing.T) {
 			return &http.Response{}
 		})
 
-		assert.EqualError(
-			t,
-			sut.Scrobble(context.Background()),
-			"scrobble: must provide at least one track",
-		)
+		_, err := sut.Scrobble(context.Background())
+		assert.EqualError(t, err, "scrobble: must provide at least one track")
 	})
 
 	t.Run("Too Many Tracks", func(t *testing.T) {
@@ -99,18 +109,15 @@ func TestAPI_Scrobble(t *testing.T) {
 		})
 
 		payload := make([]pianobar.Track, 51)
-		assert.EqualError(
-			t,
-			sut.Scrobble(context.Background(), payload...),
-			"scrobble: up to 50 tracks may be included in one scrobble request: got 51",
-		)
+		_, err := sut.Scrobble(context.Background(), payload...)
+		assert.EqualError(t, err, "scrobble: up to 50 tracks may be included in one scrobble request: got 51")
 	})
 
 	t.Run("OK", func(t *testing.T) {
 		sut := setupAPI(t, func(r *http.Request) *http.Response {
 			t.Helper()
 
-			params := r.URL.Query()
+			params := requestParams(t, r)
 
 			assertAuthenticatedSignedRequest(t, params, "track.scrobble")
 			assertHasParam(t, params, "artist[0]", "Test Artist 0")
@@ -118,7 +125,8 @@ func TestAPI_Scrobble(t *testing.T) {
 			assertHasParam(t, params, "timestamp[0]", "1287141093")
 			assertHasParam(t, params, "artist[1]", "Test Artist 1")
 			assertHasParam(t, params, "track[1]", "Test Track 1")
-			assertHasParam(t, params, "timestamp[1]", "1287141093")
+			// Timestamps must be unique within a batch
+			assertHasParam(t, params, "timestamp[1]", "1287141094")
 
 			return &http.Response{
 				StatusCode: http.StatusOK,
@@ -146,19 +154,84 @@ func TestAPI_Scrobble(t *testing.T) {
 			}
 		})
 
-		require.NoError(t, sut.Scrobble(
+		result, err := sut.Scrobble(
+			context.Background(),
+			pianobar.Track{Title: "Test Track 0", Artist: "Test Artist 0", ScrobbleAt: time.Unix(1287141093, 0)},
+			pianobar.Track{Title: "Test Track 1", Artist: "Test Artist 1", ScrobbleAt: time.Unix(1287141093, 0)},
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, result.Accepted)
+		require.Len(t, result.Tracks, 2)
+		assert.False(t, result.Tracks[0].Ignored())
+		assert.False(t, result.Tracks[1].Ignored())
+	})
+
+	t.Run("Ignored", func(t *testing.T) {
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`<?xml version='1.0' encoding='utf-8'?>
+<lfm status="ok">
+  <scrobbles accepted="1" ignored="2">
+    <scrobble>
+      <track corrected="0">Test Track 0</track>
+      <artist corrected="0">Test Artist 0</artist>
+      <timestamp>1287141093</timestamp>
+      <ignoredMessage code="0"></ignoredMessage>
+    </scrobble>
+    <scrobble>
+      <track corrected="0">Test Track 1</track>
+      <artist corrected="0">Test Artist 1</artist>
+      <timestamp>1287141093</timestamp>
+      <ignoredMessage code="3">Timestamp too old</ignoredMessage>
+    </scrobble>
+    <scrobble>
+      <track corrected="0">Test Track 2</track>
+      <artist corrected="0">Test Artist 2</artist>
+      <timestamp>1287141093</timestamp>
+      <ignoredMessage code="5"></ignoredMessage>
+    </scrobble>
+  </scrobbles>
+</lfm>`)),
+			}
+		})
+
+		result, err := sut.Scrobble(
 			context.Background(),
 			pianobar.Track{Title: "Test Track 0", Artist: "Test Artist 0", ScrobbleAt: time.Unix(1287141093, 0)},
 			pianobar.Track{Title: "Test Track 1", Artist: "Test Artist 1", ScrobbleAt: time.Unix(1287141093, 0)},
-		))
+			pianobar.Track{Title: "Test Track 2", Artist: "Test Artist 2", ScrobbleAt: time.Unix(1287141093, 0)},
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, result.Ignored)
+		require.Len(t, result.Tracks, 3)
+		assert.False(t, result.Tracks[0].Ignored())
+		assert.True(t, result.Tracks[1].Ignored())
+		assert.Equal(t, "Timestamp too old", result.Tracks[1].IgnoreReason.String())
+		assert.True(t, result.Tracks[2].Ignored())
+		assert.Equal(t, IgnoredCodeDailyLimitExceeded, result.Tracks[2].IgnoreReason.Code)
+		assert.Equal(t, "Daily scrobble limit exceeded", result.Tracks[2].IgnoreReason.String())
 	})
 }
 
+func TestUniqueTimestamps(t *testing.T) {
+	at := time.Unix(1287141093, 0)
+
+	assert.Equal(t, []int64{1287141093, 1287141094, 1287141095, 1287141100}, uniqueTimestamps([]pianobar.Track{
+		{ScrobbleAt: at},
+		{ScrobbleAt: at},
+		{ScrobbleAt: at.Add(time.Second)},
+		{ScrobbleAt: at.Add(7 * time.Second)},
+	}))
+}
+
 func TestAPI_UpdateNowPlaying(t *testing.T) {
 	sut := setupAPI(t, func(r *http.Request) *http.Response {
 		t.Helper()
 
-		params := r.URL.Query()
+		params := requestParams(t, r)
 
 		assertAuthenticatedSignedRequest(t, params, "track.updateNowPlaying")
 		assertHasParam(t, params, "artist", "Bad Wolves")
@@ -195,7 +268,7 @@ func TestAPI_FeedbackProvider(t *testing.T) {
 			sut := setupAPI(t, func(r *http.Request) *http.Response {
 				t.Helper()
 
-				params := r.URL.Query()
+				params := requestParams(t, r)
 
 				assertAuthenticatedSignedRequest(t, params, "track.love")
 				assertHasParam(t, params, "artist", "Bad Wolves")
@@ -218,7 +291,7 @@ func TestAPI_FeedbackProvider(t *testing.T) {
 			sut := setupAPI(t, func(r *http.Request) *http.Response {
 				t.Helper()
 
-				params := r.URL.Query()
+				params := requestParams(t, r)
 
 				assertAuthenticatedSignedRequest(t, params, "track.love")
 				assertHasParam(t, params, "artist", "Bad Wolves")
@@ -245,7 +318,7 @@ func TestAPI_FeedbackProvider(t *testing.T) {
 			sut := setupAPI(t, func(r *http.Request) *http.Response {
 				t.Helper()
 
-				params := r.URL.Query()
+				params := requestParams(t, r)
 
 				assertAuthenticatedSignedRequest(t, params, "track.unlove")
 				assertHasParam(t, params, "artist", "Taylor Swift")
@@ -268,7 +341,7 @@ func TestAPI_FeedbackProvider(t *testing.T) {
 			sut := setupAPI(t, func(r *http.Request) *http.Response {
 				t.Helper()
 
-				params := r.URL.Query()
+				params := requestParams(t, r)
 
 				assertAuthenticatedSignedRequest(t, params, "track.unlove")
 				assertHasParam(t, params, "artist", "Taylor Swift")
@@ -291,3 +364,236 @@ func TestAPI_FeedbackProvider(t *testing.T) {
 
 	})
 }
+
+func TestAPI_SessionExpiry(t *testing.T) {
+	failWith := func(code int) func(r *http.Request) *http.Response {
+		return func(r *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(fmt.Sprintf(`<lfm status="failed">
+  <error code="%d">dummy</error>
+</lfm>`, code))),
+			}
+		}
+	}
+
+	setup := func(t *testing.T, code int) (*API, *bool, *[]string) {
+		t.Helper()
+
+		var sessionKeys []string
+		respond := failWith(code)
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			sessionKeys = append(sessionKeys, requestParams(t, r).Get("sk"))
+			return respond(r)
+		})
+
+		var zeroed bool
+		sut.sessionKeyCache = lazy.New[string](func() {
+			zeroed = true
+		})
+		_ = sut.sessionKeyCache.Fetch(func() string {
+			return testSessionKey
+		})
+
+		return sut, &zeroed, &sessionKeys
+	}
+
+	track := pianobar.Track{Artist: "Bad Wolves", Title: "Zombie"}
+
+	for _, code := range []int{ErrCodeInvalidParameters, ErrCodeOperationFailed, ErrCodeTemporarilyUnavailable, ErrCodeRateLimitExceeded} {
+		t.Run(fmt.Sprintf("Keep/%d", code), func(t *testing.T) {
+			sut, zeroed, sessionKeys := setup(t, code)
+
+			require.Error(t, sut.LoveTrack(context.Background(), track))
+			require.Error(t, sut.LoveTrack(context.Background(), track))
+
+			assert.False(t, *zeroed, "session should not be expired")
+			assert.Equal(t, []string{testSessionKey, testSessionKey}, *sessionKeys)
+		})
+	}
+
+	for _, code := range []int{ErrCodeInvalidSessionKey, ErrCodeInvalidAPIKey} {
+		t.Run(fmt.Sprintf("Expire/%d", code), func(t *testing.T) {
+			sut, zeroed, _ := setup(t, code)
+
+			require.Error(t, sut.LoveTrack(context.Background(), track))
+			assert.True(t, *zeroed, "session should be expired")
+		})
+	}
+}
+
+func TestAPI_DesktopAuth(t *testing.T) {
+	t.Run("GetToken", func(t *testing.T) {
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			params := requestParams(t, r)
+
+			assertHasParam(t, params, "method", "auth.getToken")
+			assertHasParam(t, params, "api_key", testApiKey)
+			assert.False(t, params.Has("sk"), "session key should not be sent")
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`<lfm status="ok">
+  <token>cf45fe5a3e3cebe168480a086d7fe481</token>
+</lfm>`)),
+			}
+		})
+
+		token, err := sut.GetToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "cf45fe5a3e3cebe168480a086d7fe481", token)
+		assert.Equal(
+			t,
+			"https://www.last.fm/api/auth/?api_key=123&token=cf45fe5a3e3cebe168480a086d7fe481",
+			sut.AuthURL(token),
+		)
+	})
+
+	t.Run("WaitForSession", func(t *testing.T) {
+		var attempts int
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			params := requestParams(t, r)
+
+			assertHasParam(t, params, "method", "auth.getSession")
+			assertHasParam(t, params, "token", "abc")
+
+			attempts++
+			if attempts < 3 {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body: io.NopCloser(strings.NewReader(`<lfm status="failed">
+  <error code="14">This token has not been authorized</error>
+</lfm>`)),
+				}
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`<lfm status="ok">
+  <session>
+    <name>nlowe</name>
+    <key>d580d57f32848f5dcf574d1ce18d78b2</key>
+    <subscriber>0</subscriber>
+  </session>
+</lfm>`)),
+			}
+		})
+
+		session, err := sut.WaitForSession(context.Background(), "abc", time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, "nlowe", session.Name)
+		assert.Equal(t, "d580d57f32848f5dcf574d1ce18d78b2", session.Key)
+	})
+
+	t.Run("WaitForSession Expired", func(t *testing.T) {
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`<lfm status="failed">
+  <error code="15">This token has expired</error>
+</lfm>`)),
+			}
+		})
+
+		_, err := sut.WaitForSession(context.Background(), "abc", time.Millisecond)
+		require.ErrorContains(t, err, "Last.FM API Error Code 15")
+	})
+}
+
+func TestAPI_ensureSessionKey(t *testing.T) {
+	t.Run("Not Logged In", func(t *testing.T) {
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			t.Error("No Request should have been made")
+			return &http.Response{}
+		})
+		sut.sessionKeyCache = lazy.New[string](func() {})
+
+		err := sut.UpdateNowPlaying(context.Background(), pianobar.Track{})
+		require.ErrorIs(t, err, ErrNotLoggedIn)
+		require.True(t, IsRetryable(err))
+	})
+
+	t.Run("Login Failed", func(t *testing.T) {
+		var attempts int
+		sut := setupAPI(t, func(r *http.Request) *http.Response {
+			params := requestParams(t, r)
+			assertHasParam(t, params, "method", "auth.getMobileSession")
+
+			attempts++
+			if attempts == 1 {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body: io.NopCloser(strings.NewReader(`<lfm status="failed">
+  <error code="16">The service is temporarily unavailable, please try again.</error>
+</lfm>`)),
+				}
+			}
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(`<lfm status="ok">
+  <session>
+    <name>nlowe</name>
+    <key>d580d57f32848f5dcf574d1ce18d78b2</key>
+    <subscriber>0</subscriber>
+  </session>
+</lfm>`)),
+			}
+		})
+		sut.sessionKeyCache = lazy.New[string](func() {})
+		sut.password = "hunter2"
+
+		err := sut.ensureSessionKey(context.Background())
+
+		var sessionErr *SessionError
+		require.ErrorAs(t, err, &sessionErr)
+		require.True(t, IsRetryable(err))
+
+		// The failure should not be cached
+		require.NoError(t, sut.ensureSessionKey(context.Background()))
+		assert.Equal(t, "d580d57f32848f5dcf574d1ce18d78b2", sut.sessionKey)
+	})
+}
+
+func TestAPI_Options(t *testing.T) {
+	respond := func(r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`<lfm status="ok"></lfm>`)),
+		}
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		sut := New(lazy.New[string](func() {}), testApiKey, testApiSecret, "", "", WithHTTPClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) *http.Response {
+				assert.Equal(t, DefaultUserAgent, r.Header.Get("User-Agent"))
+
+				_, ok := r.Context().Deadline()
+				assert.False(t, ok, "request should not have a deadline")
+
+				return respond(r)
+			}),
+		}))
+
+		_, err := sut.GetToken(context.Background())
+		require.NoError(t, err)
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		sut := New(lazy.New[string](func() {}), testApiKey, testApiSecret, "", "", WithHTTPClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) *http.Response {
+				assert.Equal(t, "test/1.0", r.Header.Get("User-Agent"))
+
+				deadline, ok := r.Context().Deadline()
+				assert.True(t, ok, "request should have a deadline")
+				assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+
+				return respond(r)
+			}),
+		}), WithUserAgent("test/1.0"), WithRequestTimeout(time.Minute))
+
+		_, err := sut.GetToken(context.Background())
+		require.NoError(t, err)
+	})
+}
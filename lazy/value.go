@@ -5,13 +5,16 @@ import (
 )
 
 // Value is a simple wrapper around sync.Once that can lazy load a value
-// Once Zero is called, this value always returns the zero value for T.
+// Once Zero is called, this value always returns the zero value for T, until it is populated again by TryFetch.
 type Value[T any] struct {
 	once *sync.Once
 
 	value T
 
 	onZero func()
+
+	// zeroed is true if Zero was called since the value was last populated
+	zeroed bool
 }
 
 // New creates a new Value. The provided onZero function will be called when Zero is called
@@ -31,9 +34,35 @@ func (c *Value[T]) Fetch(populate func() T) T {
 	return c.value
 }
 
+// TryFetch returns the lazy value, calling populate to fetch it the first time. If populate returns an error, the
+// value is not cached and populate will be called again on the next call to TryFetch. If Zero was called, populate is
+// called again as well. Unlike Fetch, TryFetch is not safe for concurrent use.
+func (c *Value[T]) TryFetch(populate func() (T, error)) (T, error) {
+	if c.zeroed {
+		c.zeroed = false
+		c.once = &sync.Once{}
+	}
+
+	var err error
+	c.once.Do(func() {
+		c.value, err = populate()
+	})
+
+	if err != nil {
+		var v T
+		c.value = v
+		c.once = &sync.Once{}
+
+		return v, err
+	}
+
+	return c.value, nil
+}
+
 // Zero causes any future calls to Fetch to return the zero value for this function
 func (c *Value[T]) Zero() {
 	var v T
 	c.value = v
+	c.zeroed = true
 	c.onZero()
 }
@@ -1,6 +1,7 @@
 package lazy
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,3 +34,40 @@ func TestValue(t *testing.T) {
 		return "c"
 	}))
 }
+
+func TestValue_TryFetch(t *testing.T) {
+	sut := New[string](func() {})
+
+	_, err := sut.TryFetch(func() (string, error) {
+		return "a", fmt.Errorf("dummy")
+	})
+	assert.EqualError(t, err, "dummy")
+
+	v, err := sut.TryFetch(func() (string, error) {
+		return "b", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", v)
+
+	v, err = sut.TryFetch(func() (string, error) {
+		return "c", fmt.Errorf("dummy")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", v)
+
+	assert.Equal(t, "b", sut.Fetch(func() string {
+		return "d"
+	}))
+
+	sut.Zero()
+
+	v, err = sut.TryFetch(func() (string, error) {
+		return "e", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "e", v)
+
+	assert.Equal(t, "e", sut.Fetch(func() string {
+		return "f"
+	}))
+}
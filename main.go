@@ -7,6 +7,7 @@ import (
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 
 	"github.com/nlowe/pianoman/cmd"
+	"github.com/nlowe/pianoman/internal/redact"
 )
 
 //go:generate mockery
@@ -17,6 +18,7 @@ func main() {
 		ForceFormatting: true,
 	})
 	logrus.SetOutput(os.Stderr)
+	logrus.AddHook(redact.Std())
 
 	if cmd.NewRootCmd().Execute() != nil {
 		os.Exit(1)
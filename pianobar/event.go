@@ -0,0 +1,376 @@
+package pianobar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	keyCoverArt        = "coverArt"
+	keyStationName     = "stationName"
+	keySongStationName = "songStationName"
+	keyPRet            = "pRet"
+	keyPRetStr         = "pRetStr"
+	keyWRet            = "wRet"
+	keyWRetStr         = "wRetStr"
+	keyDetailURL       = "detailUrl"
+	keyStationCount    = "stationCount"
+	keyStationPrefix   = "station"
+)
+
+// ErrMalformedPayload is returned when an eventcmd payload can't be parsed
+var ErrMalformedPayload = errors.New("malformed payload")
+
+// maxStations is the most stations pianoman will read from a payload. Pandora limits users to 100 stations.
+const maxStations = 1000
+
+const (
+	// PandoraOK is the pRet pianobar reports when a request to Pandora succeeded
+	PandoraOK = 1
+	// NetworkOK is the wRet pianobar reports when there were no network errors
+	NetworkOK = 0
+)
+
+// Result is the outcome of a request pianobar made, as reported by pRet/pRetStr or wRet/wRetStr
+type Result struct {
+	Code    int
+	Message string
+}
+
+// PandoraIDs are the Pandora identifiers found in a detail URL. Any of them may be empty.
+type PandoraIDs struct {
+	Artist string
+	Album  string
+	Track  string
+}
+
+// Event is the full payload pianobar sends to eventcmd programs
+type Event struct {
+	Artist string
+	Title  string
+	Album  string
+
+	CoverArt        string
+	StationName     string
+	SongStationName string
+
+	// Pandora is the result of the request pianobar made to Pandora
+	Pandora Result
+	// Network is the result of the network request pianobar made
+	Network Result
+
+	SongDuration time.Duration
+	SongPlayed   time.Duration
+
+	// Rating is the rating of the track. Tracks the user is tired of are un-rated.
+	Rating Rating
+	// rawRating is the rating pianobar reported if there is no matching Rating (i.e. tired), so it is encoded as read
+	rawRating int
+
+	// DetailURL is the Pandora page for the track
+	DetailURL string
+	// IDs are the Pandora identifiers parsed from DetailURL
+	IDs PandoraIDs
+
+	// Stations is the user's station list, in pianobar's order
+	Stations []string
+
+	// Extra holds any keys pianoman doesn't know about, so they are not lost when the event is encoded
+	Extra map[string]string
+	// extraKeys are the keys in Extra, in the order they were read
+	extraKeys []string
+}
+
+// EventFromReader parses the eventcmd payload pianobar writes to stdin. Each line is a key=value pair. Whitespace
+// around keys and values, blank lines, CRLF line endings and a UTF-8 byte order mark are ignored, and lines that are
+// not valid UTF-8 are assumed to be Latin-1. Any other malformed line is an error that includes its line number.
+//
+// If the payload doesn't include pRet or wRet, the request is assumed to have succeeded. The event is not otherwise
+// validated, since not every event is about a track. For example, userlogin events have no artist or title.
+func EventFromReader(r io.Reader) (Event, error) {
+	lines := bufio.NewScanner(r)
+
+	// Payloads that don't include pRet or wRet didn't report a failure
+	result := Event{Pandora: Result{Code: PandoraOK}, Network: Result{Code: NetworkOK}}
+	var stationCount int
+	stations := map[int]string{}
+	for n := 1; lines.Scan(); n++ {
+		line := decodeLine(lines.Text())
+		if n == 1 {
+			line = strings.TrimPrefix(line, byteOrderMark)
+		}
+
+		if err := result.parseLine(line, &stationCount, stations); err != nil {
+			return result, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+
+	if err := lines.Err(); err != nil {
+		return result, fmt.Errorf("failed to read payload: %w", err)
+	}
+
+	for n := range stations {
+		stationCount = max(stationCount, n+1)
+	}
+
+	if stationCount > 0 {
+		result.Stations = make([]string, stationCount)
+		for n, v := range stations {
+			result.Stations[n] = v
+		}
+	}
+
+	return result, nil
+}
+
+// parseLine parses a single line of the payload into e, collecting the station list into stationCount and stations
+func (e *Event) parseLine(line string, stationCount *int, stations map[int]string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	k, v, ok := strings.Cut(line, "=")
+	if !ok {
+		return fmt.Errorf("%w: expected key=value, got %q", ErrMalformedPayload, line)
+	}
+
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	if k == "" {
+		return fmt.Errorf("%w: missing key in %q", ErrMalformedPayload, line)
+	}
+
+	var err error
+	switch k {
+	case keyArtist:
+		e.Artist = v
+	case keyTitle:
+		e.Title = v
+	case keyAlbum:
+		e.Album = v
+	case keyCoverArt:
+		e.CoverArt = v
+	case keyStationName:
+		e.StationName = v
+	case keySongStationName:
+		e.SongStationName = v
+	case keyPRet:
+		e.Pandora.Code, err = parseInt(k, v)
+	case keyPRetStr:
+		e.Pandora.Message = v
+	case keyWRet:
+		e.Network.Code, err = parseInt(k, v)
+	case keyWRetStr:
+		e.Network.Message = v
+	case keySongDuration:
+		e.SongDuration, err = parseSeconds(k, v)
+	case keySongPlayed:
+		e.SongPlayed, err = parseSeconds(k, v)
+	case keyRating:
+		var rating int
+		rating, err = parseInt(k, v)
+		e.Rating, e.rawRating = ratingFromPianobar(rating), 0
+		if e.Rating.pianobar() != rating {
+			e.rawRating = rating
+		}
+	case keyDetailURL:
+		e.DetailURL = v
+		e.IDs = parseDetailURL(v)
+	case keyStationCount:
+		if *stationCount, err = parseInt(k, v); err == nil && (*stationCount < 0 || *stationCount > maxStations) {
+			err = fmt.Errorf("%w: %s must be between 0 and %d, got %d", ErrMalformedPayload, k, maxStations, *stationCount)
+		}
+	default:
+		if raw, ok := strings.CutPrefix(k, keyStationPrefix); ok && isDigits(raw) {
+			n, err := parseInt(k, raw)
+			if err == nil && n >= maxStations {
+				err = fmt.Errorf("%w: at most %d stations are supported, got %s", ErrMalformedPayload, maxStations, k)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			stations[n] = v
+			return nil
+		}
+
+		if e.Extra == nil {
+			e.Extra = map[string]string{}
+		}
+
+		if _, ok := e.Extra[k]; !ok {
+			e.extraKeys = append(e.extraKeys, k)
+		}
+
+		e.Extra[k] = v
+	}
+
+	return err
+}
+
+// byteOrderMark is the UTF-8 encoded byte order mark some editors write at the start of a file
+const byteOrderMark = "\ufeff"
+
+// decodeLine returns line as valid UTF-8. pianobar writes UTF-8, so anything else is most likely Latin-1 from a
+// misconfigured locale.
+func decodeLine(line string) string {
+	if utf8.ValidString(line) {
+		return line
+	}
+
+	runes := make([]rune, len(line))
+	for i := 0; i < len(line); i++ {
+		runes[i] = rune(line[i])
+	}
+
+	return string(runes)
+}
+
+// isDigits returns true iff s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseInt parses the integer value of the specified key
+func parseInt(k, v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be an integer, got %q", ErrMalformedPayload, k, v)
+	}
+
+	return n, nil
+}
+
+// parseSeconds parses the value of the specified key as a whole number of seconds
+func parseSeconds(k, v string) (time.Duration, error) {
+	n, err := parseInt(k, v)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 || int64(n) > math.MaxInt64/int64(time.Second) {
+		return 0, fmt.Errorf("%w: %s is out of range: %d", ErrMalformedPayload, k, n)
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
+// parseDetailURL finds the Pandora identifiers in a detail URL. Pandora identifiers are path segments prefixed with AR
+// for artists, AL for albums and TR for tracks, for example:
+// https://www.pandora.com/artist/bad-wolves/nda/nda/TRxxxxxxxxxxxxx
+func parseDetailURL(raw string) PandoraIDs {
+	var result PandoraIDs
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return result
+	}
+
+	for _, segment := range strings.Split(u.Path, "/") {
+		if len(segment) <= 2 {
+			continue
+		}
+
+		switch segment[:2] {
+		case "AR":
+			result.Artist = segment
+		case "AL":
+			result.Album = segment
+		case "TR":
+			result.Track = segment
+		}
+	}
+
+	return result
+}
+
+// Succeeded returns true iff pianobar reported that its request to Pandora succeeded without network errors
+func (e Event) Succeeded() bool {
+	return e.Pandora.Code == PandoraOK && e.Network.Code == NetworkOK
+}
+
+// Track returns the track described by the event, to be scrobbled now
+func (e Event) Track() Track {
+	return Track{
+		Artist:       e.Artist,
+		Title:        e.Title,
+		Album:        e.Album,
+		Rating:       e.Rating,
+		SongDuration: e.SongDuration,
+		SongPlayed:   e.SongPlayed,
+		ScrobbleAt:   time.Now().UTC(),
+	}
+}
+
+// WriteTo writes the event to w in pianobar's key=value format. The keys pianoman knows about are written in the order
+// pianobar writes them, followed by the keys in Extra in the order they were read. Keys added to Extra after the event
+// was read are written last, sorted.
+func (e Event) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	field := func(k, v string) {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+
+	field(keyArtist, e.Artist)
+	field(keyTitle, e.Title)
+	field(keyAlbum, e.Album)
+	field(keyCoverArt, e.CoverArt)
+	field(keyStationName, e.StationName)
+	field(keySongStationName, e.SongStationName)
+	field(keyPRet, strconv.Itoa(e.Pandora.Code))
+	field(keyPRetStr, e.Pandora.Message)
+	field(keyWRet, strconv.Itoa(e.Network.Code))
+	field(keyWRetStr, e.Network.Message)
+	field(keySongDuration, strconv.Itoa(int(e.SongDuration.Seconds())))
+	field(keySongPlayed, strconv.Itoa(int(e.SongPlayed.Seconds())))
+	rating := e.Rating.pianobar()
+	if ratingFromPianobar(e.rawRating) == e.Rating {
+		rating = e.rawRating
+	}
+
+	field(keyRating, strconv.Itoa(rating))
+	field(keyDetailURL, e.DetailURL)
+	field(keyStationCount, strconv.Itoa(len(e.Stations)))
+	for i, s := range e.Stations {
+		field(fmt.Sprintf("%s%d", keyStationPrefix, i), s)
+	}
+
+	var added []string
+	for k := range e.Extra {
+		if !slices.Contains(e.extraKeys, k) {
+			added = append(added, k)
+		}
+	}
+
+	slices.Sort(added)
+	for _, k := range append(slices.Clone(e.extraKeys), added...) {
+		if v, ok := e.Extra[k]; ok {
+			field(k, v)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,269 @@
+package pianobar
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEventPayload = `artist=Bad Wolves
+title=Zombie
+album=Disobey
+coverArt=http://mediaserver-cont-dc6-1-v4v6.pandora.com/images/public/int/0/2/5/2/00602567142520_500W_500H.jpg
+stationName=QuickMix
+songStationName=Bad Wolves Radio
+pRet=1
+pRetStr=Everything is fine :)
+wRet=0
+wRetStr=No error
+songDuration=255
+songPlayed=0
+rating=1
+detailUrl=https://www.pandora.com/artist/bad-wolves/disobey/zombie/TRbV4cn7fZ3Pp9x?dc=1234&ad=1:23:1:12345
+stationCount=3
+station0=Bad Wolves Radio
+station1=Five Finger Death Punch Radio
+station2=QuickMix
+`
+
+func TestEventFromReader(t *testing.T) {
+	sut, err := EventFromReader(strings.NewReader(testEventPayload))
+	require.NoError(t, err)
+
+	assert.Equal(t, Event{
+		Artist:          "Bad Wolves",
+		Title:           "Zombie",
+		Album:           "Disobey",
+		CoverArt:        "http://mediaserver-cont-dc6-1-v4v6.pandora.com/images/public/int/0/2/5/2/00602567142520_500W_500H.jpg",
+		StationName:     "QuickMix",
+		SongStationName: "Bad Wolves Radio",
+		Pandora:         Result{Code: PandoraOK, Message: "Everything is fine :)"},
+		Network:         Result{Code: NetworkOK, Message: "No error"},
+		SongDuration:    255 * time.Second,
+		Rating:          RatingThumbsUp,
+		DetailURL:       "https://www.pandora.com/artist/bad-wolves/disobey/zombie/TRbV4cn7fZ3Pp9x?dc=1234&ad=1:23:1:12345",
+		IDs:             PandoraIDs{Track: "TRbV4cn7fZ3Pp9x"},
+		Stations:        []string{"Bad Wolves Radio", "Five Finger Death Punch Radio", "QuickMix"},
+	}, sut)
+
+	track := sut.Track()
+	assert.Equal(t, "Bad Wolves", track.Artist)
+	assert.Equal(t, "Zombie", track.Title)
+	assert.Equal(t, 255*time.Second, track.SongDuration)
+	assert.WithinDuration(t, time.Now(), track.ScrobbleAt, time.Minute)
+
+	t.Run("Missing Stations", func(t *testing.T) {
+		sut, err := EventFromReader(strings.NewReader("stationCount=3\nstation0=A\nstation2=C\n"))
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"A", "", "C"}, sut.Stations)
+	})
+
+	t.Run("Extra Keys", func(t *testing.T) {
+		sut, err := EventFromReader(strings.NewReader("artist=A\nsomethingNew=foo\n"))
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]string{"somethingNew": "foo"}, sut.Extra)
+	})
+
+	t.Run("Whitespace", func(t *testing.T) {
+		sut, err := EventFromReader(strings.NewReader("\n  artist = Test Artist \r\n\ttitle=Test Title\t\r\n\r\nsongDuration= 300\r\n"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "Test Artist", sut.Artist)
+		assert.Equal(t, "Test Title", sut.Title)
+		assert.Equal(t, 300*time.Second, sut.SongDuration)
+	})
+
+	t.Run("Byte Order Mark", func(t *testing.T) {
+		sut, err := EventFromReader(strings.NewReader("\ufeffartist=Test Artist\n"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "Test Artist", sut.Artist)
+		assert.Nil(t, sut.Extra)
+	})
+
+	t.Run("Latin-1", func(t *testing.T) {
+		sut, err := EventFromReader(strings.NewReader("artist=Mot\xf6rhead\ntitle=Hoppípolla\n"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "Motörhead", sut.Artist)
+		assert.Equal(t, "Hoppípolla", sut.Title)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, tt := range []struct {
+			name     string
+			payload  string
+			expected string
+		}{
+			{name: "Missing Separator", payload: "artist=A\ntitle\n", expected: "line 2"},
+			{name: "Missing Key", payload: "artist=A\n\n = B\n", expected: "line 3"},
+			{name: "pRet", payload: "pRet=one\n", expected: "line 1"},
+			{name: "wRet", payload: "wRet=\n", expected: "line 1"},
+			{name: "songDuration", payload: "artist=A\nsongDuration=4:15\n", expected: "line 2"},
+			{name: "Negative songPlayed", payload: "songPlayed=-1\n", expected: "line 1"},
+			{name: "Huge songPlayed", payload: "songPlayed=9223372036854775807\n", expected: "line 1"},
+			{name: "rating", payload: "rating=1.0\n", expected: "line 1"},
+			{name: "stationCount", payload: "stationCount=-1\n", expected: "line 1"},
+			{name: "Too Many Stations", payload: "station1000=A\n", expected: "line 1"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := EventFromReader(strings.NewReader(tt.payload))
+				require.ErrorIs(t, err, ErrMalformedPayload)
+				require.ErrorContains(t, err, tt.expected)
+			})
+		}
+	})
+
+	t.Run("Corpus", func(t *testing.T) {
+		for _, name := range corpus(t) {
+			t.Run(filepath.Base(name), func(t *testing.T) {
+				f, err := os.Open(name)
+				require.NoError(t, err)
+				defer func() {
+					_ = f.Close()
+				}()
+
+				sut, err := EventFromReader(f)
+				require.NoError(t, err)
+
+				assert.Equal(t, sut.Track().Validate() == nil, !strings.HasPrefix(filepath.Base(name), "userlogin"))
+			})
+		}
+	})
+}
+
+// corpus returns the paths to the real payloads in testdata
+func corpus(t testing.TB) []string {
+	t.Helper()
+
+	result, err := filepath.Glob(filepath.Join("testdata", "events", "*.txt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, result)
+
+	return result
+}
+
+func FuzzEventFromReader(f *testing.F) {
+	f.Add([]byte(testEventPayload))
+	for _, name := range corpus(f) {
+		v, err := os.ReadFile(name)
+		require.NoError(f, err)
+
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		sut, err := EventFromReader(bytes.NewReader(payload))
+		if err != nil {
+			return
+		}
+
+		// Anything we can parse must survive being encoded and parsed again
+		var b bytes.Buffer
+		_, err = sut.WriteTo(&b)
+		require.NoError(t, err)
+
+		again, err := EventFromReader(&b)
+		require.NoError(t, err)
+		assert.Equal(t, sut, again)
+	})
+}
+
+func TestEvent_Succeeded(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		payload  string
+		expected bool
+	}{
+		{name: "OK", payload: "pRet=1\npRetStr=Everything is fine :)\nwRet=0\nwRetStr=No error\n", expected: true},
+		{name: "Not Reported", payload: "artist=A\n", expected: true},
+		{name: "Pandora Error", payload: "pRet=13\npRetStr=Invalid auth token\nwRet=0\n"},
+		{name: "Request Failed", payload: "pRet=0\nwRet=0\n"},
+		{name: "Network Error", payload: "pRet=1\nwRet=28\nwRetStr=Timeout was reached\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sut, err := EventFromReader(strings.NewReader(tt.payload))
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, sut.Succeeded())
+		})
+	}
+}
+
+func TestParseDetailURL(t *testing.T) {
+	for _, tt := range []struct {
+		raw      string
+		expected PandoraIDs
+	}{
+		{raw: ""},
+		{raw: "https://www.pandora.com/artist/bad-wolves/ARxK7JbbgcbZZ9c", expected: PandoraIDs{Artist: "ARxK7JbbgcbZZ9c"}},
+		{raw: "https://www.pandora.com/artist/bad-wolves/disobey/ALk4jXjbvxPKwVq", expected: PandoraIDs{Album: "ALk4jXjbvxPKwVq"}},
+		{raw: "https://www.pandora.com/artist/bad-wolves/disobey/zombie/TRbV4cn7fZ3Pp9x", expected: PandoraIDs{Track: "TRbV4cn7fZ3Pp9x"}},
+		{raw: "https://www.pandora.com/artist/tracy/trains/treasure"},
+	} {
+		t.Run(tt.raw, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseDetailURL(tt.raw))
+		})
+	}
+}
+
+func TestEvent_WriteTo(t *testing.T) {
+	sut, err := EventFromReader(strings.NewReader(testEventPayload))
+	require.NoError(t, err)
+
+	var b strings.Builder
+	n, err := sut.WriteTo(&b)
+	require.NoError(t, err)
+
+	assert.Equal(t, testEventPayload, b.String())
+	assert.EqualValues(t, len(testEventPayload), n)
+
+	t.Run("Extra Keys", func(t *testing.T) {
+		sut.Extra = map[string]string{"b": "2", "a": "1"}
+
+		var b strings.Builder
+		_, err := sut.WriteTo(&b)
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasSuffix(b.String(), "station2=QuickMix\na=1\nb=2\n"))
+	})
+
+	t.Run("Round Trip", func(t *testing.T) {
+		const payload = "rating=3\nzebra=1\napple=2\n"
+
+		sut, err := EventFromReader(strings.NewReader(payload))
+		require.NoError(t, err)
+		assert.Equal(t, RatingNone, sut.Rating)
+
+		sut.Extra["mango"] = "3"
+
+		var b strings.Builder
+		_, err = sut.WriteTo(&b)
+		require.NoError(t, err)
+
+		// Tired tracks keep their rating, and extra keys are written in the order they were read
+		assert.Contains(t, b.String(), "\nrating=3\n")
+		assert.True(t, strings.HasSuffix(b.String(), "stationCount=0\nzebra=1\napple=2\nmango=3\n"))
+	})
+
+	t.Run("Rating Changed", func(t *testing.T) {
+		sut, err := EventFromReader(strings.NewReader("rating=3\n"))
+		require.NoError(t, err)
+
+		sut.Rating = RatingThumbsUp
+
+		var b strings.Builder
+		_, err = sut.WriteTo(&b)
+		require.NoError(t, err)
+
+		assert.Contains(t, b.String(), "\nrating=1\n")
+	})
+}
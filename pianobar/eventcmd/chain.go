@@ -0,0 +1,89 @@
+package eventcmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultChainTimeout is how long a chained program may run for if no timeout is specified
+const DefaultChainTimeout = 30 * time.Second
+
+// Next is a program that eventcmd invocations are chained to
+type Next struct {
+	// Command is the path to the program to invoke
+	Command string
+	// Timeout is the maximum amount of time the program may run for. If zero, DefaultChainTimeout is used.
+	Timeout time.Duration
+	// Events is an optional allow-list of events to chain. If empty, all events are chained.
+	Events []string
+}
+
+// ShouldInvoke returns true iff the program should be invoked for the specified event
+func (n Next) ShouldInvoke(event string) bool {
+	return len(n.Events) == 0 || slices.ContainsFunc(n.Events, func(e string) bool {
+		return strings.EqualFold(e, event)
+	})
+}
+
+// Chain invokes each of the provided programs exactly like pianobar invoked us, with the event as the only argument
+// and the eventcmd payload on stdin. Programs are invoked in order, and each program is invoked regardless of whether
+// any previous program failed. Any errors are joined and returned.
+func Chain(ctx context.Context, event string, payload io.Reader, next ...Next) error {
+	if len(next) == 0 {
+		return nil
+	}
+
+	// Save the event payload, so it can be replayed to each program
+	raw, err := io.ReadAll(payload)
+	if err != nil {
+		return fmt.Errorf("chain: failed to read eventcmd payload: %w", err)
+	}
+
+	var result error
+	for _, n := range next {
+		if !n.ShouldInvoke(event) {
+			log.Tracef("Not chaining %s to %s due to event filter", event, n.Command)
+			continue
+		}
+
+		if err = invokeNext(ctx, event, raw, n); err != nil {
+			result = errors.Join(result, err)
+		}
+	}
+
+	return result
+}
+
+func invokeNext(ctx context.Context, event string, payload []byte, n Next) error {
+	timeout := n.Timeout
+	if timeout <= 0 {
+		timeout = DefaultChainTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Debugf("Chaining %s to %s", event, n.Command)
+	cmd := exec.CommandContext(ctx, n.Command, event)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("chain: %s timed out after %s: %w", n.Command, timeout, err)
+		}
+
+		return fmt.Errorf("chain: %s failed: %w", n.Command, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package eventcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "next.sh")
+	require.NoError(t, os.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0o700))
+
+	return p
+}
+
+func TestNext_ShouldInvoke(t *testing.T) {
+	assert.True(t, Next{}.ShouldInvoke(EventSongStart), "empty filter")
+	assert.True(t, Next{Events: []string{"SongStart"}}.ShouldInvoke(EventSongStart), "case insensitive")
+	assert.False(t, Next{Events: []string{EventSongFinish}}.ShouldInvoke(EventSongStart), "filtered")
+}
+
+func TestChain(t *testing.T) {
+	t.Run("Replays Payload", func(t *testing.T) {
+		out := t.TempDir()
+
+		var next []Next
+		for i := 0; i < 2; i++ {
+			next = append(next, Next{
+				Command: writeScript(t, fmt.Sprintf(`cat > "%s/$1.%d"`, out, i)),
+			})
+		}
+
+		require.NoError(t, Chain(context.Background(), EventSongStart, strings.NewReader(defaultTestTrack), next...))
+
+		for i := 0; i < 2; i++ {
+			v, err := os.ReadFile(filepath.Join(out, fmt.Sprintf("%s.%d", EventSongStart, i)))
+			require.NoError(t, err)
+			assert.Equal(t, defaultTestTrack, string(v))
+		}
+	})
+
+	t.Run("Filtered", func(t *testing.T) {
+		out := t.TempDir()
+
+		require.NoError(t, Chain(context.Background(), EventSongStart, strings.NewReader(defaultTestTrack), Next{
+			Command: writeScript(t, fmt.Sprintf(`touch "%s/invoked"`, out)),
+			Events:  []string{EventSongFinish},
+		}))
+
+		assert.NoFileExists(t, filepath.Join(out, "invoked"))
+	})
+
+	t.Run("Errors Do Not Stop Chain", func(t *testing.T) {
+		out := t.TempDir()
+
+		err := Chain(context.Background(), EventSongStart, strings.NewReader(defaultTestTrack),
+			Next{Command: writeScript(t, "exit 1")},
+			Next{Command: writeScript(t, "exec sleep 5"), Timeout: 50 * time.Millisecond},
+			Next{Command: writeScript(t, fmt.Sprintf(`touch "%s/invoked"`, out))},
+		)
+
+		require.ErrorContains(t, err, "failed: exit status 1")
+		require.ErrorContains(t, err, "timed out after 50ms")
+		assert.FileExists(t, filepath.Join(out, "invoked"))
+	})
+}
@@ -0,0 +1,310 @@
+package eventcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nlowe/pianoman/internal/breaker"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/wal"
+)
+
+// Backlog holds tracks waiting to be scrobbled, as well as tracks that left the WAL without being scrobbled
+type Backlog struct {
+	// WAL holds tracks waiting to be scrobbled
+	WAL *wal.WAL[pianobar.Track]
+	// Rejected records tracks Last.FM accepted a request for but ignored
+	Rejected *wal.Journal[Rejection]
+	// DeadLetters records tracks Last.FM refused with an error that should not be retried, and tracks that expired
+	DeadLetters *wal.Journal[DeadLetter]
+	// Pending holds requests other than scrobbles that were queued by handling events with Defer
+	Pending *wal.Journal[Operation]
+	// Playing records when tracks started playing
+	Playing *PlayState
+
+	// MaxAge is how long a track may wait in the WAL before it is given up on. Zero means tracks never expire.
+	MaxAge time.Duration
+}
+
+// WithContext returns a copy of b that stops waiting for other processes to release the WAL, the pending journal, or
+// the play state when ctx is done. The rejected and dead-letter journals are left alone, since they record the outcome
+// of requests that were already sent.
+func (b Backlog) WithContext(ctx context.Context) Backlog {
+	b.WAL = b.WAL.WithContext(ctx)
+	b.Pending = b.Pending.WithContext(ctx)
+	b.Playing = b.Playing.WithContext(ctx)
+
+	return b
+}
+
+// Rejection is a track Last.FM refused to scrobble, along with the reason it was rejected
+type Rejection struct {
+	Track      pianobar.Track `json:"track"`
+	Reason     string         `json:"reason"`
+	RejectedAt time.Time      `json:"rejectedAt"`
+}
+
+// DeadLetter is a track that caused Last.FM to fail a scrobble request with an error that should not be retried
+type DeadLetter struct {
+	Track   pianobar.Track `json:"track"`
+	Code    int            `json:"code"`
+	Message string         `json:"message"`
+	// Attempts is the number of scrobble requests that included the track
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+func newDeadLetter(t pianobar.Track, attempts int, err error) DeadLetter {
+	result := DeadLetter{Track: t, Message: err.Error(), Attempts: attempts, FailedAt: time.Now()}
+
+	var lfmErr *lastfm.Error
+	if errors.As(err, &lfmErr) {
+		result.Code = lfmErr.Code
+		result.Message = lfmErr.Message
+	}
+
+	return result
+}
+
+// Flush tries to scrobble the backlog of tracks in the WAL, in order. Tracks are removed from the WAL as they are
+// scrobbled or rejected by Last.FM, and rejected tracks are written to the rejected journal. Tracks Last.FM ignored
+// because the daily scrobble limit was exceeded are kept in the WAL to be retried. Tracks older than the backlog's
+// MaxAge are moved to the dead-letter journal without being sent, since Last.FM would ignore them anyway.
+//
+// If Last.FM fails a batch with an error that should not be retried, the batch is split in half and each half is
+// retried until the tracks that caused the error are found. Those tracks are moved to the dead-letter journal and the
+// rest are scrobbled. Errors that affect every request (i.e. an invalid API key) are never blamed on the tracks: the
+// tracks that haven't been scrobbled yet are kept to be retried later instead. Processing stops at the first error
+// that should be retried, and that error is returned. If the Scrobbler's circuit breaker is open or the context is
+// done, processing stops without counting it as a failed attempt. Tracks that were handled before the context was done
+// are still removed from the WAL.
+func Flush(ctx context.Context, b Backlog, s lastfm.Scrobbler) error {
+	return b.WAL.Process(func(segment wal.Segment[pianobar.Track]) ([]wal.Result, error) {
+		if err := ctx.Err(); err != nil {
+			// We're out of time, leave the rest of the backlog for later
+			return nil, fmt.Errorf("%w: %w", wal.ErrSkipped, err)
+		}
+
+		tracks := segment.Records()
+		results := make([]wal.Result, len(tracks))
+
+		deadLetters, send := b.expire(tracks, results)
+
+		var rejections []Rejection
+		var scrobbleErr error
+		if len(send) > 0 {
+			batch := make([]pianobar.Track, len(send))
+			for i, j := range send {
+				batch[i] = tracks[j]
+			}
+
+			batchResults := make([]wal.Result, len(batch))
+			r, d, err := scrobble(ctx, s, batch, batchResults)
+			if errors.Is(err, breaker.ErrOpen) {
+				// Nothing was sent, so don't count this as an attempt
+				return nil, fmt.Errorf("%w: %w", wal.ErrSkipped, err)
+			}
+
+			for i, j := range send {
+				results[j] = batchResults[i]
+			}
+
+			rejections = r
+			deadLetters = append(deadLetters, d...)
+			scrobbleErr = err
+		}
+
+		if len(rejections) > 0 {
+			if err := b.Rejected.Append(rejections...); err != nil {
+				log.WithError(err).Errorf("Failed to record %d rejected track(s)", len(rejections))
+			}
+		}
+
+		if len(deadLetters) > 0 {
+			if err := b.DeadLetters.Append(deadLetters...); err != nil {
+				log.WithError(err).Errorf("Failed to record %d dead letter(s)", len(deadLetters))
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			// We ran out of time, which says nothing about whether Last.FM would have accepted the rest of the tracks.
+			// Keep the progress we made without counting the rest as a failed attempt.
+			return results, fmt.Errorf("%w: %w", wal.ErrSkipped, err)
+		}
+
+		// If Last.FM told us to stop, keep the progress we made but don't send any more segments
+		return results, scrobbleErr
+	})
+}
+
+// expire fills in results for tracks older than MaxAge, returning dead letters for them and the indices of the tracks
+// that should still be sent
+func (b Backlog) expire(tracks []pianobar.Track, results []wal.Result) ([]DeadLetter, []int) {
+	send := make([]int, 0, len(tracks))
+	if b.MaxAge <= 0 {
+		for i := range tracks {
+			send = append(send, i)
+		}
+
+		return nil, send
+	}
+
+	var deadLetters []DeadLetter
+	var names []string
+
+	cutoff := time.Now().Add(-b.MaxAge)
+	for i, t := range tracks {
+		if !t.ScrobbleAt.Before(cutoff) {
+			send = append(send, i)
+			continue
+		}
+
+		reason := fmt.Sprintf("scrobble is older than %s", b.MaxAge)
+		results[i] = wal.Result{Outcome: wal.Ignored, Reason: reason}
+		deadLetters = append(deadLetters, DeadLetter{Track: t, Message: reason, FailedAt: time.Now()})
+		names = append(names, fmt.Sprintf("%s - %s (%s)", t.Artist, t.Title, t.ScrobbleAt.Local().Format(time.DateTime)))
+	}
+
+	if len(deadLetters) > 0 {
+		log.Warnf(
+			"Giving up on %d track(s) older than %s, moving them to the dead-letter journal: %s",
+			len(deadLetters), b.MaxAge, strings.Join(names, ", "),
+		)
+	}
+
+	return deadLetters, send
+}
+
+// scrobble scrobbles a batch of tracks, bisecting it if Last.FM fails the batch with an error that should not be
+// retried. Results are filled in for each track, and the tracks Last.FM ignored and the tracks that caused an error are
+// returned. If Last.FM fails the batch with an error that should be retried or that would fail any request, every
+// track is marked to be retried and that error is returned. If bisecting stops early, the results found so far are
+// kept and the error that stopped it is returned.
+func scrobble(ctx context.Context, s lastfm.Scrobbler, tracks []pianobar.Track, results []wal.Result) ([]Rejection, []DeadLetter, error) {
+	resp, err := s.Scrobble(ctx, tracks...)
+	if err != nil && (lastfm.IsRetryable(err) || lastfm.IsAuthError(err)) {
+		retry(results, err)
+		return nil, nil, fmt.Errorf("failed to scrobble tracks: %w", err)
+	}
+
+	if err != nil {
+		log.WithError(err).Warnf("Last.FM rejected %d track(s), searching for the track(s) that caused it", len(tracks))
+		rejections, deadLetters, err := bisect(ctx, s, tracks, results, 1, err)
+		if err != nil {
+			err = fmt.Errorf("failed to scrobble tracks: %w", err)
+		}
+
+		return rejections, deadLetters, err
+	}
+
+	return ignored(tracks, results, resp), nil, nil
+}
+
+// bisect splits a batch of tracks that Last.FM failed with the specified error in half, and tries to scrobble each
+// half separately. Halves that fail with an error that should not be retried are split again, until the tracks that
+// caused the error are found. Results are filled in for each track, and the tracks Last.FM ignored and the tracks that
+// caused an error are returned. attempts is the number of requests that included the tracks so far.
+//
+// If a half fails with an error that would fail any request, or because we're sending too many requests, the search
+// stops: that half and any tracks that haven't been sent yet are marked to be retried, and the error is returned. The
+// search also stops once the context is done.
+func bisect(
+	ctx context.Context,
+	s lastfm.Scrobbler,
+	tracks []pianobar.Track,
+	results []wal.Result,
+	attempts int,
+	err error,
+) ([]Rejection, []DeadLetter, error) {
+	if len(tracks) == 1 {
+		log.WithError(err).WithFields(logrus.Fields{
+			"artist": tracks[0].Artist,
+			"title":  tracks[0].Title,
+		}).Warn("Last.FM rejected track, moving it to the dead-letter journal")
+
+		results[0] = wal.Result{Outcome: wal.Ignored, Reason: err.Error()}
+		return nil, []DeadLetter{newDeadLetter(tracks[0], attempts, err)}, nil
+	}
+
+	var rejections []Rejection
+	var deadLetters []DeadLetter
+	var stopErr error
+
+	mid := len(tracks) / 2
+	for _, half := range [][2]int{{0, mid}, {mid, len(tracks)}} {
+		batch, batchResults := tracks[half[0]:half[1]], results[half[0]:half[1]]
+		if stopErr == nil {
+			stopErr = ctx.Err()
+		}
+
+		if stopErr != nil {
+			retry(batchResults, stopErr)
+			continue
+		}
+
+		resp, err := s.Scrobble(ctx, batch...)
+		switch {
+		case err == nil:
+			rejections = append(rejections, ignored(batch, batchResults, resp)...)
+		case lastfm.IsAuthError(err):
+			log.WithError(err).Warn("Last.FM refused the request for a reason unrelated to the tracks, retrying them later")
+			retry(batchResults, err)
+			stopErr = err
+		case lastfm.IsRateLimited(err):
+			log.WithError(err).Warn("Rate limited by Last.FM, backing off and retrying the rest later")
+			retry(batchResults, err)
+			stopErr = err
+		case lastfm.IsRetryable(err):
+			log.WithError(err).Warnf("Failed to scrobble %d track(s), they will be retried", len(batch))
+			retry(batchResults, err)
+		default:
+			r, d, err := bisect(ctx, s, batch, batchResults, attempts+1, err)
+			rejections = append(rejections, r...)
+			deadLetters = append(deadLetters, d...)
+			stopErr = err
+		}
+	}
+
+	return rejections, deadLetters, stopErr
+}
+
+// retry marks every track in a batch to be retried because of the specified error
+func retry(results []wal.Result, err error) {
+	for i := range results {
+		results[i] = wal.Result{Outcome: wal.Retry, Reason: err.Error()}
+	}
+}
+
+// ignored fills in results for tracks Last.FM ignored, returning the tracks that should not be retried
+func ignored(tracks []pianobar.Track, results []wal.Result, resp lastfm.ScrobbleResult) []Rejection {
+	var rejections []Rejection
+	for i, t := range resp.Tracks {
+		if i >= len(results) || !t.Ignored() {
+			continue
+		}
+
+		log := log.WithFields(logrus.Fields{
+			"artist": tracks[i].Artist,
+			"title":  tracks[i].Title,
+		})
+
+		reason := t.IgnoreReason.String()
+		if t.IgnoreReason.Code == lastfm.IgnoredCodeDailyLimitExceeded {
+			log.Infof("Last.FM ignored track, it will be retried later: %s", reason)
+			results[i] = wal.Result{Outcome: wal.Retry, Reason: reason}
+			continue
+		}
+
+		log.Warnf("Last.FM ignored track: %s", reason)
+		results[i] = wal.Result{Outcome: wal.Ignored, Reason: reason}
+		rejections = append(rejections, Rejection{Track: tracks[i], Reason: reason, RejectedAt: time.Now()})
+	}
+
+	return rejections
+}
@@ -0,0 +1,397 @@
+package eventcmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/internal/breaker"
+	"github.com/nlowe/pianoman/internal/fake"
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/lazy"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/wal"
+)
+
+const testSessionKey = "secret"
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newTestAPI constructs a real Last.FM client with a session, that sends requests to respond instead of Last.FM.
+// respond is called with the parameters of each request, and returns the body of the response.
+func newTestAPI(t *testing.T, respond func(params url.Values) string) *lastfm.API {
+	t.Helper()
+
+	cache := lazy.New[string](func() {})
+	_ = cache.Fetch(func() string {
+		return testSessionKey
+	})
+
+	client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		require.NoError(t, r.ParseForm())
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(respond(r.PostForm))),
+		}, nil
+	})}
+
+	return lastfm.New(cache, "key", "shh", "", "", lastfm.WithHTTPClient(client))
+}
+
+// scrobbledTitles returns the titles of the tracks in a scrobble request
+func scrobbledTitles(params url.Values) []string {
+	var result []string
+	for i := 0; params.Has(fmt.Sprintf("track[%d]", i)); i++ {
+		result = append(result, params.Get(fmt.Sprintf("track[%d]", i)))
+	}
+
+	return result
+}
+
+func TestFlush(t *testing.T) {
+	tracks := []pianobar.Track{
+		{Artist: "Test Artist", Title: "Accepted"},
+		{Artist: "Test Artist", Title: "Ignored"},
+		{Artist: "Test Artist", Title: "Limited"},
+	}
+
+	setupFlush := func(t *testing.T) (Backlog, *fake.Scrobbler) {
+		b, s, _ := setup(t)
+		for _, track := range tracks {
+			require.NoError(t, b.WAL.Append(track))
+		}
+
+		return b, s
+	}
+
+	t.Run("Ignored", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{
+			Accepted: 1,
+			Ignored:  2,
+			Tracks: []lastfm.Track{
+				{},
+				{IgnoreReason: lastfm.IgnoredMessage{Code: lastfm.IgnoredCodeArtist}},
+				{IgnoreReason: lastfm.IgnoredMessage{Code: lastfm.IgnoredCodeDailyLimitExceeded}},
+			},
+		}, nil)
+
+		require.NoError(t, Flush(context.Background(), b, s))
+
+		assert.Equal(t, []pianobar.Track{tracks[2]}, walRecords(t, b))
+
+		rejections, err := b.Rejected.Records()
+		require.NoError(t, err)
+		require.Len(t, rejections, 1)
+		assert.Equal(t, tracks[1], rejections[0].Track)
+		assert.Equal(t, "Artist was ignored", rejections[0].Reason)
+		assert.WithinDuration(t, time.Now(), rejections[0].RejectedAt, time.Minute)
+	})
+
+	t.Run("Bisect", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		poison := &lastfm.Error{Code: lastfm.ErrCodeInvalidParameters, Message: "Invalid parameters"}
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, poison).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[0]).Return(lastfm.ScrobbleResult{}, nil).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, poison).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[1]).Return(lastfm.ScrobbleResult{}, poison).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[2]).Return(lastfm.ScrobbleResult{}, nil).Once()
+
+		require.NoError(t, Flush(context.Background(), b, s))
+		assert.Empty(t, walRecords(t, b))
+
+		rejections, err := b.Rejected.Records()
+		require.NoError(t, err)
+		assert.Empty(t, rejections)
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+		assert.Equal(t, tracks[1], deadLetters[0].Track)
+		assert.Equal(t, lastfm.ErrCodeInvalidParameters, deadLetters[0].Code)
+		assert.Equal(t, "Invalid parameters", deadLetters[0].Message)
+		assert.Equal(t, 3, deadLetters[0].Attempts)
+		assert.WithinDuration(t, time.Now(), deadLetters[0].FailedAt, time.Minute)
+	})
+
+	t.Run("Bisect With Last.FM Client", func(t *testing.T) {
+		b, _ := setupFlush(t)
+
+		var requests [][]string
+		sut := newTestAPI(t, func(params url.Values) string {
+			assert.Equal(t, testSessionKey, params.Get("sk"), "every request should use the session")
+
+			titles := scrobbledTitles(params)
+			requests = append(requests, titles)
+			if slices.Contains(titles, "Ignored") {
+				return `<lfm status="failed"><error code="6">Invalid parameters</error></lfm>`
+			}
+
+			return fmt.Sprintf(`<lfm status="ok"><scrobbles accepted="%d" ignored="0"></scrobbles></lfm>`, len(titles))
+		})
+
+		require.NoError(t, Flush(context.Background(), b, sut))
+		assert.Empty(t, walRecords(t, b))
+		assert.Equal(t, [][]string{{"Accepted", "Ignored", "Limited"}, {"Accepted"}, {"Ignored", "Limited"}, {"Ignored"}, {"Limited"}}, requests)
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+		assert.Equal(t, tracks[1], deadLetters[0].Track)
+	})
+
+	t.Run("Bisect Retry", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeInvalidParameters,
+			Message: "Invalid parameters",
+		}).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[0]).Return(lastfm.ScrobbleResult{}, nil).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, fmt.Errorf("dummy")).Once()
+
+		require.NoError(t, Flush(context.Background(), b, s))
+		assert.Equal(t, tracks[1:], walRecords(t, b))
+	})
+
+	t.Run("Rate Limited While Bisecting", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeInvalidParameters,
+			Message: "Invalid parameters",
+		}).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[0]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeRateLimitExceeded,
+			Message: "Rate limit exceeded",
+		}).Once()
+
+		// The second half should not be sent
+		err := Flush(context.Background(), b, s)
+		require.Error(t, err)
+		assert.True(t, lastfm.IsRateLimited(err))
+		assert.Equal(t, tracks, walRecords(t, b))
+
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		assert.Equal(t, 1, segments[0].Metadata().Attempts)
+	})
+
+	t.Run("Account Error", func(t *testing.T) {
+		b, _ := setupFlush(t)
+
+		var requests int
+		sut := newTestAPI(t, func(params url.Values) string {
+			requests++
+			return `<lfm status="failed"><error code="10">Invalid API key</error></lfm>`
+		})
+
+		require.Error(t, Flush(context.Background(), b, sut))
+		assert.Equal(t, 1, requests)
+		assert.Equal(t, tracks, walRecords(t, b))
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		assert.Empty(t, deadLetters)
+
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		assert.Equal(t, 1, segments[0].Metadata().Attempts)
+	})
+
+	t.Run("Account Error While Bisecting", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeInvalidParameters,
+			Message: "Invalid parameters",
+		}).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[0]).Return(lastfm.ScrobbleResult{}, nil).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeSuspendedAPIKey,
+			Message: "Suspended API key",
+		}).Once()
+
+		err := Flush(context.Background(), b, s)
+		require.Error(t, err)
+		assert.True(t, lastfm.IsAuthError(err))
+		assert.Equal(t, tracks[1:], walRecords(t, b))
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		assert.Empty(t, deadLetters)
+	})
+
+	t.Run("Rate Limited Stops Flush", func(t *testing.T) {
+		b, s, _ := setup(t)
+
+		// Keep each batch in its own segment
+		var err error
+		b.WAL, err = wal.Open[pianobar.Track](filepath.Join(t.TempDir(), "wal"), len(tracks))
+		require.NoError(t, err)
+
+		next := pianobar.Track{Artist: "Test Artist", Title: "Next Segment"}
+		for _, track := range append(slices.Clone(tracks), next) {
+			require.NoError(t, b.WAL.Append(track))
+		}
+
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeInvalidParameters,
+			Message: "Invalid parameters",
+		}).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[0]).Return(lastfm.ScrobbleResult{}, nil).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeRateLimitExceeded,
+			Message: "Rate limit exceeded",
+		}).Once()
+
+		// The next segment should not be sent, and the tracks that weren't scrobbled should back off
+		err = Flush(context.Background(), b, s)
+		require.Error(t, err)
+		assert.True(t, lastfm.IsRateLimited(err))
+		assert.Equal(t, []pianobar.Track{tracks[1], tracks[2], next}, walRecords(t, b))
+
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 2)
+		assert.Equal(t, 1, segments[0].Metadata().Attempts)
+		assert.Zero(t, segments[1].Metadata())
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		b, s, _ := setup(t)
+		b.MaxAge = 14 * 24 * time.Hour
+
+		expired := pianobar.Track{Artist: "Test Artist", Title: "Expired", ScrobbleAt: time.Now().Add(-15 * 24 * time.Hour).Truncate(time.Second).UTC()}
+		fresh := pianobar.Track{Artist: "Test Artist", Title: "Fresh", ScrobbleAt: time.Now().Add(-time.Hour).Truncate(time.Second).UTC()}
+		require.NoError(t, b.WAL.Append(expired))
+		require.NoError(t, b.WAL.Append(fresh))
+
+		s.EXPECT().Scrobble(mock.Anything, fresh).Return(lastfm.ScrobbleResult{}, nil).Once()
+
+		require.NoError(t, Flush(context.Background(), b, s))
+		assert.Empty(t, walRecords(t, b))
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+		assert.Equal(t, "Expired", deadLetters[0].Track.Title)
+		assert.Equal(t, "scrobble is older than 336h0m0s", deadLetters[0].Message)
+		assert.Zero(t, deadLetters[0].Attempts)
+	})
+
+	t.Run("All Expired", func(t *testing.T) {
+		b, s, _ := setup(t)
+		b.MaxAge = time.Hour
+
+		require.NoError(t, b.WAL.Append(pianobar.Track{Artist: "Test Artist", Title: "Expired", ScrobbleAt: time.Now().Add(-2 * time.Hour)}))
+
+		require.NoError(t, Flush(context.Background(), b, s))
+		assert.Empty(t, walRecords(t, b))
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		assert.Len(t, deadLetters, 1)
+	})
+
+	t.Run("Circuit Open", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, fmt.Errorf("dummy: %w", breaker.ErrOpen))
+
+		require.ErrorIs(t, Flush(context.Background(), b, s), breaker.ErrOpen)
+		assert.Equal(t, tracks, walRecords(t, b))
+
+		// Nothing was sent, so the segment shouldn't back off
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		assert.Zero(t, segments[0].Metadata())
+	})
+
+	t.Run("Out of Time", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		require.ErrorIs(t, Flush(ctx, b, s), context.Canceled)
+		assert.Equal(t, tracks, walRecords(t, b))
+
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		assert.Zero(t, segments[0].Metadata())
+	})
+
+	t.Run("Out of Time While Scrobbling", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).RunAndReturn(
+			func(context.Context, ...pianobar.Track) (lastfm.ScrobbleResult, error) {
+				cancel()
+				return lastfm.ScrobbleResult{}, fmt.Errorf("dummy: %w", context.Canceled)
+			},
+		).Once()
+
+		require.ErrorIs(t, Flush(ctx, b, s), context.Canceled)
+		assert.Equal(t, tracks, walRecords(t, b))
+
+		// Running out of time says nothing about Last.FM, so the segment shouldn't back off
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		assert.Zero(t, segments[0].Metadata())
+	})
+
+	t.Run("Out of Time While Bisecting", func(t *testing.T) {
+		b, s := setupFlush(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.EXPECT().Scrobble(mock.Anything, tracks[0], tracks[1], tracks[2]).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
+			Code:    lastfm.ErrCodeInvalidParameters,
+			Message: "Invalid parameters",
+		}).Once()
+		s.EXPECT().Scrobble(mock.Anything, tracks[0]).RunAndReturn(
+			func(context.Context, ...pianobar.Track) (lastfm.ScrobbleResult, error) {
+				cancel()
+				return lastfm.ScrobbleResult{}, nil
+			},
+		).Once()
+
+		// The second half should not be sent, but the first half should still be removed
+		require.ErrorIs(t, Flush(ctx, b, s), context.Canceled)
+		assert.Equal(t, tracks[1:], walRecords(t, b))
+
+		deadLetters, err := b.DeadLetters.Records()
+		require.NoError(t, err)
+		assert.Empty(t, deadLetters)
+
+		segments, err := b.WAL.Segments()
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		assert.Zero(t, segments[0].Metadata())
+	})
+}
@@ -5,12 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"slices"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/nlowe/pianoman/internal/breaker"
 	"github.com/nlowe/pianoman/lastfm"
 	"github.com/nlowe/pianoman/pianobar"
 	"github.com/nlowe/pianoman/wal"
@@ -18,30 +18,47 @@ import (
 
 var log = logrus.WithField("prefix", "handler")
 
-type EventFlags uint8
+type EventFlags uint16
 
 const (
 	EventSongStart  = "songstart"
 	EventSongFinish = "songfinish"
 	EventSongLove   = "songlove"
 	EventSongBan    = "songban"
+	EventUserLogin  = "userlogin"
 
 	HandleSongStart EventFlags = 1 << iota
 	HandleSongFinish
 	HandleSongLove
 	HandleSongBan
+
+	// IgnoreThumbsDown prevents tracks that have been given a thumbs-down from being scrobbled. Tracks that are banned
+	// while they are playing or after they have been queued for scrobbling are removed from the WAL.
+	IgnoreThumbsDown
+
+	// Defer queues requests to Last.FM instead of sending them. Tracks to scrobble are appended to the WAL, and other
+	// requests are recorded in the pending journal to be sent later by Drain.
+	Defer
+
+	// IgnorePianobarErrors handles events even if pianobar reports that its request failed. By default, tracks are not
+	// scrobbled and feedback is not sent if pianobar's request to Pandora failed.
+	IgnorePianobarErrors
 )
 
 func (e EventFlags) checkEventAndFlags(event, desired string, flag EventFlags) bool {
 	return strings.EqualFold(desired, event) && (e&flag == flag)
 }
 
-// ShouldHandle returns true iff the correct flag is set for the specified event
+// ShouldHandle returns true iff the correct flag is set for the specified event. songstart and userlogin are also
+// handled when scrobbling, to record when each track started playing and recover tracks that never finished.
 func (e EventFlags) ShouldHandle(event string) bool {
 	return e.checkEventAndFlags(event, EventSongStart, HandleSongStart) ||
+		e.checkEventAndFlags(event, EventSongStart, HandleSongFinish) ||
+		e.checkEventAndFlags(event, EventUserLogin, HandleSongFinish) ||
 		e.checkEventAndFlags(event, EventSongFinish, HandleSongFinish) ||
 		e.checkEventAndFlags(event, EventSongLove, HandleSongLove) ||
-		e.checkEventAndFlags(event, EventSongBan, HandleSongBan)
+		e.checkEventAndFlags(event, EventSongBan, HandleSongBan) ||
+		e.checkEventAndFlags(event, EventSongBan, IgnoreThumbsDown)
 }
 
 // Handle processes a command executed by pianobar's eventcmd interface. First, it checks to see if the provided event
@@ -51,12 +68,13 @@ func (e EventFlags) ShouldHandle(event string) bool {
 // well as any error from the handling of the event.
 //
 // In either case, if event chaining is enabled, the returned reader can be used to re-read the eventcmd payload.
+// Waiting for other processes to release the backlog stops once ctx is done.
 func Handle(
 	ctx context.Context,
 	event string,
 	handle EventFlags,
 	stdin io.Reader,
-	w wal.WAL[pianobar.Track],
+	b Backlog,
 	s lastfm.Scrobbler,
 	f lastfm.FeedbackProvider,
 ) (io.Reader, error) {
@@ -76,14 +94,22 @@ func Handle(
 	log.Tracef("Received event payload: \n%s\n", payload)
 
 	next := strings.NewReader(payload)
+	b = b.WithContext(ctx)
 
-	// All of the events we could handle use a track as the payload
-	track, err := pianobar.TrackFromReader(strings.NewReader(payload))
+	ev, err := pianobar.EventFromReader(strings.NewReader(payload))
 	if err != nil {
-		return next, fmt.Errorf("failed to parse track from eventcmd payload: %w", err)
+		return next, fmt.Errorf("failed to parse eventcmd payload: %w", err)
+	}
+
+	// All of the events we could handle other than userlogin are about a track
+	track := ev.Track()
+	if event != EventUserLogin {
+		if err = track.Validate(); err != nil {
+			return next, fmt.Errorf("invalid %s payload: %w", event, err)
+		}
 	}
 
-	log = log.WithFields(logrus.Fields{
+	log := log.WithFields(logrus.Fields{
 		"artist": track.Artist,
 		"album":  track.Album,
 		"title":  track.Title,
@@ -93,70 +119,190 @@ func Handle(
 	var love bool
 	switch event {
 	case EventSongStart:
-		log.Info("Updating Now Playing")
-		err = s.UpdateNowPlaying(ctx, track)
-		love = track.ThumbsUp
+		orphans, startErr := b.Playing.Start(track, track.ScrobbleAt)
+		if startErr != nil {
+			log.WithError(startErr).Warn("Failed to record when the track started playing")
+		}
+
+		err = recoverPlays(handle, orphans, b)
+
+		if handle&HandleSongStart != HandleSongStart {
+			break
+		}
+
+		if handle&Defer == Defer {
+			err = errors.Join(err, b.queue(EventSongStart, track))
+		} else {
+			log.Info("Updating Now Playing")
+			err = errors.Join(err, unavailable(log, s.UpdateNowPlaying(ctx, track), "updating now playing"))
+		}
+		love = track.Rating == pianobar.RatingThumbsUp
 	case EventSongFinish:
+		// Last.FM expects the time the track started playing
+		track.ScrobbleAt = b.startedAt(track)
+		if pianobarFailed(handle, ev, log, "scrobble") {
+			break
+		}
+
 		log.Info("Scrobbling Track")
-		err = handleFinish(ctx, track, w, s)
-		love = track.ThumbsUp
+		err = handleFinish(ctx, log, handle, track, b, s)
+		love = track.Rating == pianobar.RatingThumbsUp
+	case EventUserLogin:
+		// pianobar was restarted, so anything that was playing before will never finish
+		var orphans []Play
+		if orphans, err = b.Playing.Clear(); err == nil {
+			err = recoverPlays(handle, orphans, b)
+		}
 	case EventSongLove:
-		love = true
+		love = !pianobarFailed(handle, ev, log, "feedback")
 	case EventSongBan:
-		log.Info("Sending feedback to Last.FM")
-		// Last.FM doesn't have a ban/block, the best we can do is un-love
-		err = f.UnLoveTrack(ctx, track)
+		if !pianobarFailed(handle, ev, log, "feedback") {
+			err = handleBan(ctx, log, handle, track, b, f)
+		}
 	default:
 		err = fmt.Errorf("unknown event: %s", event)
 	}
 
-	if love {
+	if love && handle&Defer == Defer {
+		err = errors.Join(err, b.queue(EventSongLove, track))
+	} else if love {
 		log.Info("Sending feedback to Last.FM")
-		err = errors.Join(err, f.LoveTrack(ctx, track))
+		err = errors.Join(err, unavailable(log, f.LoveTrack(ctx, track), "sending feedback"))
 	}
 
 	// And return the saved reader and any error from event handling
 	return next, err
 }
 
-func handleFinish(ctx context.Context, t pianobar.Track, w wal.WAL[pianobar.Track], s lastfm.Scrobbler) error {
+func handleBan(
+	ctx context.Context,
+	log *logrus.Entry,
+	handle EventFlags,
+	t pianobar.Track,
+	b Backlog,
+	f lastfm.FeedbackProvider,
+) error {
+	var err error
+	if handle&IgnoreThumbsDown == IgnoreThumbsDown {
+		// pianobar sends songban before songfinish, so if the track is still playing it isn't in the WAL yet, and it
+		// won't be scrobbled when it finishes since it has a thumbs-down. Any plays of the same song in the WAL were
+		// never banned.
+		playing, playErr := b.Playing.IsPlaying(t)
+		switch {
+		case playErr != nil:
+			err = fmt.Errorf("failed to check whether banned track is playing: %w", playErr)
+		case playing:
+			log.Debug("Banned track is still playing, it won't be scrobbled")
+		default:
+			// Make sure we don't scrobble the track if it's still waiting to be scrobbled. Earlier plays of the same
+			// song weren't banned, so only the most recent one is removed.
+			var removed bool
+			removed, err = b.WAL.RemoveLast(t.SameSong)
+			if err != nil {
+				err = fmt.Errorf("failed to remove banned track from WAL: %w", err)
+			} else if removed {
+				log.Info("Removed pending scrobble for banned track")
+			}
+		}
+	}
+
+	if handle&(HandleSongBan|Defer) == HandleSongBan|Defer {
+		err = errors.Join(err, b.queue(EventSongBan, t))
+	} else if handle&HandleSongBan == HandleSongBan {
+		log.Info("Sending feedback to Last.FM")
+		// Last.FM doesn't have a ban/block, the best we can do is un-love
+		err = errors.Join(err, unavailable(log, f.UnLoveTrack(ctx, t), "sending feedback"))
+	}
+
+	return err
+}
+
+// pianobarFailed returns true if pianobar reported that its request failed and the event should not be sent to
+// Last.FM, logging pianobar's error along with the action that was skipped
+func pianobarFailed(handle EventFlags, ev pianobar.Event, log *logrus.Entry, action string) bool {
+	if handle&IgnorePianobarErrors == IgnorePianobarErrors || ev.Succeeded() {
+		return false
+	}
+
+	log.WithFields(logrus.Fields{
+		"pRet":    ev.Pandora.Code,
+		"pRetStr": ev.Pandora.Message,
+		"wRet":    ev.Network.Code,
+		"wRetStr": ev.Network.Message,
+	}).Warnf("pianobar reported an error, skipping %s", action)
+
+	return true
+}
+
+// shouldScrobble returns true iff t meets the requirements for a scrobble
+func shouldScrobble(log *logrus.Entry, handle EventFlags, t pianobar.Track) bool {
+	if handle&IgnoreThumbsDown == IgnoreThumbsDown && t.Rating == pianobar.RatingThumbsDown {
+		log.Info("Not scrobbling track with a thumbs-down")
+		return false
+	}
+
 	// Check if we've met the requirements for a scrobble
 	//
 	// From: https://www.last.fm/api/scrobbling#when-is-a-scrobble-a-scrobble
 	// * The track must be longer than 30 seconds.
 	// * And the track has been played for at least half its duration, or for 4 minutes (whichever occurs earlier.)
 	if t.SongDuration < 30*time.Second {
-		return nil
+		return false
 	}
 
-	if !(t.SongPlayed > 4*time.Minute || (float64(t.SongPlayed)/float64(t.SongDuration)) > 0.5) {
+	return t.SongPlayed > 4*time.Minute || (float64(t.SongPlayed)/float64(t.SongDuration)) > 0.5
+}
+
+func handleFinish(
+	ctx context.Context,
+	log *logrus.Entry,
+	handle EventFlags,
+	t pianobar.Track,
+	b Backlog,
+	s lastfm.Scrobbler,
+) error {
+	if !shouldScrobble(log, handle, t) {
 		return nil
 	}
 
 	// Append the track to the WAL in case of an error
-	if err := w.Append(t); err != nil {
+	if err := b.WAL.Append(t); err != nil {
 		return fmt.Errorf("failed to append track to WAL: %w", err)
 	}
 
+	if handle&Defer == Defer {
+		log.Debug("Leaving track in the WAL to be scrobbled in the background")
+		return nil
+	}
+
 	// Try to scrobble the WAL Backlog
-	return w.Process(func(segment wal.Segment[pianobar.Track]) error {
-		err := s.Scrobble(ctx, segment.Records()...)
-
-		// Only retry invalid session key, service offline, and service unavailable
-		// Additionally, retry Operation Failed and Rate Limit Exceeded
-		// Any other errors (i.e. from the network stack) will be retried.
-		lfm := &lastfm.Error{}
-		if err != nil && errors.As(err, &lfm) {
-			if !slices.Contains([]int{8, 9, 11, 16, 29}, lfm.Code) {
-				// This error shouldn't be retried according to the LFM Docs
-				err = nil
-			}
-		}
+	err := Flush(ctx, b, s)
+	if errors.Is(err, wal.ErrBusy) {
+		// Someone else is already scrobbling the backlog, they'll pick up this track too
+		log.Debug("WAL is already being processed")
+		return nil
+	}
 
-		if err != nil {
-			err = fmt.Errorf("failed to scrobble tracks: %w", err)
-		}
+	if errors.Is(err, breaker.ErrOpen) {
+		log.WithError(err).Info("Last.FM is unreachable, the track will be scrobbled later")
+		return nil
+	}
 
-		return err
-	})
+	if ctx.Err() != nil && errors.Is(err, context.DeadlineExceeded) {
+		log.WithError(err).Info("Ran out of time to scrobble the backlog, the remaining tracks will be scrobbled later")
+		return nil
+	}
+
+	return err
+}
+
+// unavailable ignores err if it was caused by the circuit breaker skipping a request to Last.FM, since there's no
+// point in failing the event while Last.FM is down
+func unavailable(log *logrus.Entry, err error, action string) error {
+	if errors.Is(err, breaker.ErrOpen) {
+		log.WithError(err).Warnf("Last.FM is unreachable, not %s", action)
+		return nil
+	}
+
+	return err
 }
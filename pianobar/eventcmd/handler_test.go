@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nlowe/pianoman/internal/breaker"
 	"github.com/nlowe/pianoman/internal/fake"
 	"github.com/nlowe/pianoman/lastfm"
 	"github.com/nlowe/pianoman/pianobar"
@@ -28,17 +34,44 @@ func isDefaultTestTrack(v any) bool {
 	return vt.Album == "Test Album" && vt.Artist == "Test Artist" && vt.Title == "Test Title"
 }
 
-func setup(t *testing.T) (w wal.WAL[pianobar.Track], s *fake.Scrobbler, f *fake.FeedbackProvider) {
+func setup(t *testing.T) (b Backlog, s *fake.Scrobbler, f *fake.FeedbackProvider) {
 	t.Helper()
 	d := t.TempDir()
 
-	w, err := wal.Open[pianobar.Track](d, lastfm.MaxTracksPerScrobble)
+	w, err := wal.Open[pianobar.Track](filepath.Join(d, "wal"), lastfm.MaxTracksPerScrobble)
 	require.NoError(t, err)
 
-	return w, fake.NewScrobbler(t), fake.NewFeedbackProvider(t)
+	rejected, err := wal.OpenJournal[Rejection](filepath.Join(d, "rejected.jsonl"))
+	require.NoError(t, err)
+
+	deadLetters, err := wal.OpenJournal[DeadLetter](filepath.Join(d, "deadletters.jsonl"))
+	require.NoError(t, err)
+
+	pending, err := wal.OpenJournal[Operation](filepath.Join(d, "pending.jsonl"))
+	require.NoError(t, err)
+
+	playing, err := OpenPlayState(filepath.Join(d, "playing.json"), wal.DefaultLockTimeout)
+	require.NoError(t, err)
+
+	b = Backlog{WAL: w, Rejected: rejected, DeadLetters: deadLetters, Pending: pending, Playing: playing}
+	return b, fake.NewScrobbler(t), fake.NewFeedbackProvider(t)
+}
+
+// walRecords returns all records in the WAL without consuming them
+func walRecords(t *testing.T, b Backlog) []pianobar.Track {
+	t.Helper()
+
+	var result []pianobar.Track
+	_, err := b.WAL.Remove(func(v pianobar.Track) bool {
+		result = append(result, v)
+		return false
+	})
+	require.NoError(t, err)
+
+	return result
 }
 
-func invokeExpecting(t *testing.T, errHandler func(require.TestingT, error, ...any), event string, flags EventFlags, payload string, w wal.WAL[pianobar.Track], s *fake.Scrobbler, f *fake.FeedbackProvider) {
+func invokeExpecting(t *testing.T, errHandler func(require.TestingT, error, ...any), event string, flags EventFlags, payload string, w Backlog, s *fake.Scrobbler, f *fake.FeedbackProvider) {
 	t.Helper()
 	next, err := Handle(context.Background(), event, flags, strings.NewReader(payload), w, s, f)
 	errHandler(t, err)
@@ -48,7 +81,7 @@ func invokeExpecting(t *testing.T, errHandler func(require.TestingT, error, ...a
 	require.Equal(t, payload, string(v))
 }
 
-func invoke(t *testing.T, event string, flags EventFlags, payload string, w wal.WAL[pianobar.Track], s *fake.Scrobbler, f *fake.FeedbackProvider) {
+func invoke(t *testing.T, event string, flags EventFlags, payload string, w Backlog, s *fake.Scrobbler, f *fake.FeedbackProvider) {
 	t.Helper()
 
 	invokeExpecting(t, require.NoError, event, flags, payload, w, s, f)
@@ -62,6 +95,149 @@ func TestHandler_songstart(t *testing.T) {
 	invoke(t, EventSongStart, HandleSongStart, defaultTestTrack, w, s, f)
 }
 
+func TestHandler_LogFields(t *testing.T) {
+	w, s, f := setup(t)
+
+	s.EXPECT().UpdateNowPlaying(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(nil)
+
+	invoke(t, EventSongStart, HandleSongStart, defaultTestTrack, w, s, f)
+
+	// Fields for the track should not leak into logs for later events
+	assert.Equal(t, logrus.Fields{"prefix": "handler"}, log.Data)
+}
+
+func TestHandler_CircuitOpen(t *testing.T) {
+	w, s, f := setup(t)
+
+	s.EXPECT().UpdateNowPlaying(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(fmt.Errorf("dummy: %w", breaker.ErrOpen))
+	f.EXPECT().LoveTrack(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(fmt.Errorf("dummy: %w", breaker.ErrOpen))
+
+	invoke(t, EventSongStart, HandleSongStart, defaultTestTrack+"\nrating=1", w, s, f)
+}
+
+func TestHandler_InvalidPayload(t *testing.T) {
+	all := HandleSongStart | HandleSongFinish | HandleSongLove | HandleSongBan
+
+	for _, event := range []string{EventSongStart, EventSongFinish, EventSongLove, EventSongBan} {
+		t.Run(event, func(t *testing.T) {
+			w, s, f := setup(t)
+
+			invokeExpecting(t, require.Error, event, all, "artist=\ntitle=Test Title\nsongDuration=300\nsongPlayed=300", w, s, f)
+			require.Empty(t, walRecords(t, w))
+		})
+	}
+
+	t.Run("Malformed", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		invokeExpecting(t, func(t require.TestingT, err error, _ ...any) {
+			require.ErrorIs(t, err, pianobar.ErrMalformedPayload)
+			require.ErrorContains(t, err, "line 6")
+		}, EventSongFinish, all, defaultTestTrack+"\nrating=up", w, s, f)
+	})
+}
+
+func TestHandler_StartTime(t *testing.T) {
+	t.Run("Recorded", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		// songstart is handled to record the start time, even if now playing is disabled
+		require.True(t, HandleSongFinish.ShouldHandle(EventSongStart))
+		invoke(t, EventSongStart, HandleSongFinish, defaultTestTrack, w, s, f)
+
+		plays, err := os.ReadFile(w.Playing.path)
+		require.NoError(t, err)
+		require.Contains(t, string(plays), "Test Title")
+
+		// Pretend the track started a while ago
+		startedAt := time.Now().Add(-10 * time.Minute).Truncate(time.Second).UTC()
+		_, err = w.Playing.Start(pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album"}, startedAt)
+		require.NoError(t, err)
+
+		var started time.Time
+		s.EXPECT().Scrobble(mock.Anything, mock.MatchedBy(func(v pianobar.Track) bool {
+			started = v.ScrobbleAt
+			return isDefaultTestTrack(v)
+		})).Return(lastfm.ScrobbleResult{}, nil)
+
+		invoke(t, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
+		assert.Equal(t, startedAt, started)
+
+		// The start time is only used once
+		_, ok, err := w.Playing.Finish(pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album"})
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("Estimated", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		var started time.Time
+		s.EXPECT().Scrobble(mock.Anything, mock.MatchedBy(func(v pianobar.Track) bool {
+			started = v.ScrobbleAt
+			return isDefaultTestTrack(v)
+		})).Return(lastfm.ScrobbleResult{}, nil)
+
+		invoke(t, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
+
+		// defaultTestTrack was played for 175 seconds
+		assert.WithinDuration(t, time.Now().Add(-175*time.Second), started, 5*time.Second)
+	})
+}
+
+func TestHandler_Recover(t *testing.T) {
+	orphan := pianobar.Track{Artist: "Test Artist", Title: "Orphan", SongDuration: 5 * time.Minute}
+
+	start := func(t *testing.T, b Backlog, ago time.Duration) time.Time {
+		t.Helper()
+
+		at := time.Now().Add(-ago).Truncate(time.Second).UTC()
+		_, err := b.Playing.Start(orphan, at)
+		require.NoError(t, err)
+
+		return at
+	}
+
+	t.Run("songstart", func(t *testing.T) {
+		w, s, f := setup(t)
+		at := start(t, w, time.Hour)
+
+		invoke(t, EventSongStart, HandleSongFinish, defaultTestTrack, w, s, f)
+
+		records := walRecords(t, w)
+		require.Len(t, records, 1)
+		assert.Equal(t, "Orphan", records[0].Title)
+		assert.Equal(t, at, records[0].ScrobbleAt)
+		assert.Equal(t, orphan.SongDuration, records[0].SongPlayed, "played time should be capped at the duration")
+		assert.True(t, records[0].Recovered)
+	})
+
+	t.Run("Not Played Long Enough", func(t *testing.T) {
+		w, s, f := setup(t)
+		start(t, w, 10*time.Second)
+
+		invoke(t, EventSongStart, HandleSongFinish, defaultTestTrack, w, s, f)
+
+		require.Empty(t, walRecords(t, w))
+	})
+
+	t.Run("userlogin", func(t *testing.T) {
+		w, s, f := setup(t)
+		start(t, w, 3*time.Minute)
+
+		invoke(t, EventUserLogin, HandleSongFinish, "pRet=1\npRetStr=Everything is fine :)\nwRet=0\nwRetStr=No error", w, s, f)
+
+		records := walRecords(t, w)
+		require.Len(t, records, 1)
+		assert.Equal(t, "Orphan", records[0].Title)
+		assert.True(t, records[0].Recovered)
+
+		plays, err := w.Playing.Clear()
+		require.NoError(t, err)
+		assert.Empty(t, plays)
+	})
+}
+
 func TestHandler_songfinish(t *testing.T) {
 	t.Run("Too Short", func(t *testing.T) {
 		w, s, f := setup(t)
@@ -94,7 +270,7 @@ album=Test Album
 songDuration=600
 songPlayed=270`
 
-			s.EXPECT().Scrobble(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(nil)
+			s.EXPECT().Scrobble(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(lastfm.ScrobbleResult{}, nil)
 
 			invoke(t, EventSongFinish, HandleSongFinish, payload, w, s, f)
 		})
@@ -106,7 +282,7 @@ songPlayed=270`
 				vt := v.(pianobar.Track)
 
 				return vt.Album == "Test Album" && vt.Artist == "Test Artist" && vt.Title == "Test Title"
-			})).Return(nil)
+			})).Return(lastfm.ScrobbleResult{}, nil)
 
 			invoke(t, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
 		})
@@ -116,7 +292,7 @@ songPlayed=270`
 			t.Run("Terminal", func(t *testing.T) {
 				w, s, f := setup(t)
 
-				s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(&lastfm.Error{
+				s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
 					Code:    7,
 					Message: "Invalid resource specified",
 				})
@@ -124,22 +300,58 @@ songPlayed=270`
 				invoke(t, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
 			})
 
+			t.Run("Circuit Open", func(t *testing.T) {
+				w, s, f := setup(t)
+
+				s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, fmt.Errorf("dummy: %w", breaker.ErrOpen))
+
+				invoke(t, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
+
+				require.Len(t, walRecords(t, w), 1)
+			})
+
+			t.Run("Out of Time", func(t *testing.T) {
+				w, s, f := setup(t)
+
+				ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+				defer cancel()
+
+				_, err := Handle(ctx, EventSongFinish, HandleSongFinish, strings.NewReader(defaultTestTrack), w, s, f)
+				require.NoError(t, err)
+
+				require.Len(t, walRecords(t, w), 1)
+			})
+
 			t.Run("Retry", func(t *testing.T) {
 				t.Run("Generic Errors", func(t *testing.T) {
 					w, s, f := setup(t)
 
-					s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(fmt.Errorf("dummy"))
+					s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, fmt.Errorf("dummy"))
 
 					invokeExpecting(t, func(t require.TestingT, err error, _ ...any) {
 						require.ErrorContains(t, err, "dummy")
 					}, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
 				})
 
+				t.Run("Session Errors", func(t *testing.T) {
+					w, s, f := setup(t)
+
+					s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.SessionError{
+						Err: &lastfm.Error{Code: 4, Message: "Authentication Failed"},
+					})
+
+					invokeExpecting(t, func(t require.TestingT, err error, _ ...any) {
+						require.ErrorContains(t, err, "failed to login to Last.FM")
+					}, EventSongFinish, HandleSongFinish, defaultTestTrack, w, s, f)
+
+					require.Len(t, walRecords(t, w), 1)
+				})
+
 				t.Run("LastFM Errors", func(t *testing.T) {
 					t.Run("OperationFailed", func(t *testing.T) {
 						w, s, f := setup(t)
 
-						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(&lastfm.Error{
+						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
 							Code:    8,
 							Message: "Operation failed - Most likely the backend service failed. Please try again.",
 						})
@@ -152,7 +364,7 @@ songPlayed=270`
 					t.Run("InvalidSessionKey", func(t *testing.T) {
 						w, s, f := setup(t)
 
-						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(&lastfm.Error{
+						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
 							Code:    9,
 							Message: "Invalid session key - Please re-authenticate",
 						})
@@ -165,7 +377,7 @@ songPlayed=270`
 					t.Run("ServiceOffline", func(t *testing.T) {
 						w, s, f := setup(t)
 
-						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(&lastfm.Error{
+						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
 							Code:    11,
 							Message: "Service Offline - This service is temporarily offline. Try again later.",
 						})
@@ -178,7 +390,7 @@ songPlayed=270`
 					t.Run("ServiceUnavailable", func(t *testing.T) {
 						w, s, f := setup(t)
 
-						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(&lastfm.Error{
+						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
 							Code:    16,
 							Message: "The service is temporarily unavailable, please try again.",
 						})
@@ -191,7 +403,7 @@ songPlayed=270`
 					t.Run("RateLimitExceeded", func(t *testing.T) {
 						w, s, f := setup(t)
 
-						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(&lastfm.Error{
+						s.EXPECT().Scrobble(mock.Anything, mock.Anything).Return(lastfm.ScrobbleResult{}, &lastfm.Error{
 							Code:    29,
 							Message: "Rate Limit Exceded - Your IP has made too many requests in a short period, exceeding our API guidelines",
 						})
@@ -221,3 +433,159 @@ func TestHandler_songban(t *testing.T) {
 
 	invoke(t, EventSongBan, HandleSongBan, defaultTestTrack, w, s, f)
 }
+
+func TestHandler_IgnoreThumbsDown(t *testing.T) {
+	t.Run("songfinish", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		invoke(t, EventSongFinish, HandleSongFinish|IgnoreThumbsDown, defaultTestTrack+"\nrating=2", w, s, f)
+
+		require.Empty(t, walRecords(t, w))
+	})
+
+	t.Run("songban", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		require.NoError(t, w.WAL.Append(pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album"}))
+		require.NoError(t, w.WAL.Append(pianobar.Track{Artist: "Test Artist", Title: "Other Title", Album: "Test Album"}))
+
+		invoke(t, EventSongBan, IgnoreThumbsDown, defaultTestTrack, w, s, f)
+
+		records := walRecords(t, w)
+		require.Len(t, records, 1)
+		require.Equal(t, "Other Title", records[0].Title)
+	})
+
+	t.Run("songban played before", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		earlier := pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album", ScrobbleAt: time.Now().Add(-time.Hour).Truncate(time.Second).UTC()}
+		require.NoError(t, w.WAL.Append(earlier))
+		require.NoError(t, w.WAL.Append(pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album", ScrobbleAt: time.Now().Truncate(time.Second).UTC()}))
+
+		invoke(t, EventSongBan, IgnoreThumbsDown, defaultTestTrack, w, s, f)
+
+		// Only the play that was banned should be removed
+		assert.Equal(t, []pianobar.Track{earlier}, walRecords(t, w))
+	})
+
+	t.Run("songban while playing", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		earlier := pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album", ScrobbleAt: time.Now().Add(-time.Hour).Truncate(time.Second).UTC()}
+		require.NoError(t, w.WAL.Append(earlier))
+
+		playing := earlier
+		playing.ScrobbleAt = time.Now().Truncate(time.Second).UTC()
+		_, err := w.Playing.Start(playing, playing.ScrobbleAt)
+		require.NoError(t, err)
+
+		invoke(t, EventSongBan, IgnoreThumbsDown, defaultTestTrack, w, s, f)
+
+		// The banned play hasn't finished yet, so the earlier play should still be scrobbled
+		assert.Equal(t, []pianobar.Track{earlier}, walRecords(t, w))
+	})
+
+	t.Run("songban with feedback", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		require.NoError(t, w.WAL.Append(pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album"}))
+		f.EXPECT().UnLoveTrack(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(nil)
+
+		invoke(t, EventSongBan, HandleSongBan|IgnoreThumbsDown, defaultTestTrack, w, s, f)
+
+		require.Empty(t, walRecords(t, w))
+	})
+}
+
+func TestHandler_PianobarError(t *testing.T) {
+	const failed = defaultTestTrack + "\nrating=1\npRet=13\npRetStr=Invalid auth token\nwRet=0\nwRetStr=No error"
+
+	t.Run("songfinish", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		invoke(t, EventSongFinish, HandleSongFinish|HandleSongLove, failed, w, s, f)
+
+		require.Empty(t, walRecords(t, w))
+	})
+
+	t.Run("songlove", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		invoke(t, EventSongLove, HandleSongLove, failed, w, s, f)
+	})
+
+	t.Run("songban", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		track, err := pianobar.TrackFromReader(strings.NewReader(defaultTestTrack))
+		require.NoError(t, err)
+		require.NoError(t, w.WAL.Append(track))
+
+		invoke(t, EventSongBan, HandleSongBan|IgnoreThumbsDown, failed, w, s, f)
+
+		require.Len(t, walRecords(t, w), 1, "track should not be removed if the ban failed")
+	})
+
+	t.Run("songstart", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		s.EXPECT().UpdateNowPlaying(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(nil)
+		f.EXPECT().LoveTrack(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(nil)
+
+		invoke(t, EventSongStart, HandleSongStart, failed, w, s, f)
+	})
+
+	t.Run("Ignored", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		f.EXPECT().LoveTrack(mock.Anything, mock.MatchedBy(isDefaultTestTrack)).Return(nil)
+
+		invoke(t, EventSongLove, HandleSongLove|IgnorePianobarErrors, failed, w, s, f)
+	})
+}
+
+func TestHandler_Defer(t *testing.T) {
+	pending := func(t *testing.T, b Backlog) []string {
+		t.Helper()
+
+		ops, err := b.Pending.Records()
+		require.NoError(t, err)
+
+		var result []string
+		for _, op := range ops {
+			require.True(t, isDefaultTestTrack(op.Track))
+			result = append(result, op.Event)
+		}
+
+		return result
+	}
+
+	t.Run("songstart", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		invoke(t, EventSongStart, HandleSongStart|Defer, defaultTestTrack+"\nrating=1", w, s, f)
+
+		assert.Equal(t, []string{EventSongStart, EventSongLove}, pending(t, w))
+	})
+
+	t.Run("songfinish", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		invoke(t, EventSongFinish, HandleSongFinish|Defer, defaultTestTrack, w, s, f)
+
+		require.Len(t, walRecords(t, w), 1)
+		assert.Empty(t, pending(t, w))
+	})
+
+	t.Run("songban", func(t *testing.T) {
+		w, s, f := setup(t)
+
+		require.NoError(t, w.WAL.Append(pianobar.Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album"}))
+
+		invoke(t, EventSongBan, HandleSongBan|IgnoreThumbsDown|Defer, defaultTestTrack, w, s, f)
+
+		assert.Empty(t, walRecords(t, w))
+		assert.Equal(t, []string{EventSongBan}, pending(t, w))
+	})
+}
@@ -0,0 +1,103 @@
+package eventcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/pianobar"
+	"github.com/nlowe/pianoman/wal"
+)
+
+// Operation is a request to Last.FM that was queued to be sent later
+type Operation struct {
+	// Event is the event that caused the request
+	Event    string         `json:"event"`
+	Track    pianobar.Track `json:"track"`
+	QueuedAt time.Time      `json:"queuedAt"`
+}
+
+// queue records the request for the specified event in the pending journal
+func (b Backlog) queue(event string, t pianobar.Track) error {
+	log.Debugf("Queueing %s to be sent in the background", event)
+	if err := b.Pending.Append(Operation{Event: event, Track: t, QueuedAt: time.Now()}); err != nil {
+		return fmt.Errorf("failed to queue %s: %w", event, err)
+	}
+
+	return nil
+}
+
+// Drain sends the requests in the pending journal, in the order they were queued. Requests are only removed from the
+// journal once they have been handled, so they aren't lost if Drain is interrupted. Now-playing updates for tracks that
+// have since finished are dropped, and so are updates that fail. Feedback that fails with an error that should be
+// retried is kept, and any other failures are logged and dropped. If Last.FM says we're sending too many requests, the
+// rest are kept without being sent. If another process is already sending the requests, Drain does nothing.
+func Drain(ctx context.Context, b Backlog, s lastfm.Scrobbler, f lastfm.FeedbackProvider) error {
+	err := b.Pending.Process(func(ops []Operation) ([]int, error) {
+		var done []int
+		var limited bool
+		for i, op := range ops {
+			log := log.WithFields(logrus.Fields{
+				"event":  op.Event,
+				"artist": op.Track.Artist,
+				"title":  op.Track.Title,
+			})
+
+			if ctx.Err() != nil || limited {
+				continue
+			}
+
+			var err error
+			switch op.Event {
+			case EventSongStart:
+				if time.Since(op.QueuedAt) > op.Track.SongDuration {
+					log.Debug("Track has already finished, not updating now playing")
+					done = append(done, i)
+					continue
+				}
+
+				log.Info("Updating Now Playing")
+				err = s.UpdateNowPlaying(ctx, op.Track)
+			case EventSongLove:
+				log.Info("Sending feedback to Last.FM")
+				err = f.LoveTrack(ctx, op.Track)
+			case EventSongBan:
+				log.Info("Sending feedback to Last.FM")
+				err = f.UnLoveTrack(ctx, op.Track)
+			default:
+				err = fmt.Errorf("unknown event: %s", op.Event)
+			}
+
+			if err == nil {
+				done = append(done, i)
+				continue
+			}
+
+			if lastfm.IsRateLimited(err) {
+				log.WithError(err).Warn("Rate limited by Last.FM, backing off until the next flush")
+				limited = true
+			}
+
+			if op.Event != EventSongStart && lastfm.IsRetryable(err) {
+				log.WithError(err).Warn("Failed to send queued request, it will be retried later")
+				continue
+			}
+
+			log.WithError(err).Warn("Failed to send queued request, dropping it")
+			done = append(done, i)
+		}
+
+		return done, ctx.Err()
+	})
+
+	if errors.Is(err, wal.ErrBusy) {
+		log.Debug("Queued requests are already being sent by another process")
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,112 @@
+package eventcmd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/lastfm"
+	"github.com/nlowe/pianoman/pianobar"
+)
+
+func TestDrain(t *testing.T) {
+	track := pianobar.Track{Artist: "Test Artist", Title: "Test Title", SongDuration: 5 * time.Minute}
+
+	t.Run("Sends Requests", func(t *testing.T) {
+		b, s, f := setup(t)
+
+		require.NoError(t, b.queue(EventSongStart, track))
+		require.NoError(t, b.queue(EventSongLove, track))
+		require.NoError(t, b.queue(EventSongBan, track))
+
+		s.EXPECT().UpdateNowPlaying(mock.Anything, track).Return(nil).Once()
+		f.EXPECT().LoveTrack(mock.Anything, track).Return(nil).Once()
+		f.EXPECT().UnLoveTrack(mock.Anything, track).Return(nil).Once()
+
+		require.NoError(t, Drain(context.Background(), b, s, f))
+
+		ops, err := b.Pending.Records()
+		require.NoError(t, err)
+		assert.Empty(t, ops)
+	})
+
+	t.Run("Stale Now Playing", func(t *testing.T) {
+		b, s, f := setup(t)
+
+		require.NoError(t, b.Pending.Append(Operation{Event: EventSongStart, Track: track, QueuedAt: time.Now().Add(-time.Hour)}))
+
+		require.NoError(t, Drain(context.Background(), b, s, f))
+	})
+
+	t.Run("Failures", func(t *testing.T) {
+		b, s, f := setup(t)
+
+		require.NoError(t, b.queue(EventSongStart, track))
+		require.NoError(t, b.queue(EventSongLove, track))
+		require.NoError(t, b.queue(EventSongBan, track))
+
+		s.EXPECT().UpdateNowPlaying(mock.Anything, track).Return(fmt.Errorf("dummy")).Once()
+		f.EXPECT().LoveTrack(mock.Anything, track).Return(fmt.Errorf("dummy")).Once()
+		f.EXPECT().UnLoveTrack(mock.Anything, track).Return(&lastfm.Error{Code: lastfm.ErrCodeInvalidParameters}).Once()
+
+		require.NoError(t, Drain(context.Background(), b, s, f))
+
+		// Only the feedback that failed with an error that should be retried is kept
+		ops, err := b.Pending.Records()
+		require.NoError(t, err)
+		require.Len(t, ops, 1)
+		assert.Equal(t, EventSongLove, ops[0].Event)
+	})
+
+	t.Run("Rate Limited", func(t *testing.T) {
+		b, s, f := setup(t)
+
+		require.NoError(t, b.queue(EventSongLove, track))
+		require.NoError(t, b.queue(EventSongBan, track))
+
+		f.EXPECT().LoveTrack(mock.Anything, track).Return(&lastfm.Error{Code: lastfm.ErrCodeRateLimitExceeded}).Once()
+
+		require.NoError(t, Drain(context.Background(), b, s, f))
+
+		// Nothing else should be sent until the next flush
+		ops, err := b.Pending.Records()
+		require.NoError(t, err)
+		require.Len(t, ops, 2)
+		assert.Equal(t, EventSongLove, ops[0].Event)
+		assert.Equal(t, EventSongBan, ops[1].Event)
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		b, s, f := setup(t)
+
+		require.NoError(t, b.queue(EventSongLove, track))
+		require.NoError(t, b.queue(EventSongBan, track))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		f.EXPECT().LoveTrack(mock.Anything, track).RunAndReturn(func(context.Context, pianobar.Track) error {
+			// Nothing should be removed from the journal until it has been sent
+			ops, err := b.Pending.Records()
+			require.NoError(t, err)
+			assert.Len(t, ops, 2)
+
+			// Requests queued while draining should be kept
+			require.NoError(t, b.queue(EventSongStart, track))
+
+			cancel()
+			return nil
+		}).Once()
+
+		require.ErrorIs(t, Drain(ctx, b, s, f), context.Canceled)
+
+		ops, err := b.Pending.Records()
+		require.NoError(t, err)
+		require.Len(t, ops, 2)
+		assert.Equal(t, EventSongBan, ops[0].Event)
+		assert.Equal(t, EventSongStart, ops[1].Event)
+	})
+}
@@ -0,0 +1,213 @@
+package eventcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nlowe/pianoman/internal/flock"
+	"github.com/nlowe/pianoman/pianobar"
+)
+
+// Play is a track pianobar started playing
+type Play struct {
+	Track     pianobar.Track `json:"track"`
+	StartedAt time.Time      `json:"startedAt"`
+}
+
+// PlayState records when pianobar started playing tracks, so they can be scrobbled with the time they started instead
+// of the time they finished. It may be safely shared by multiple processes.
+type PlayState struct {
+	path        string
+	lockTimeout time.Duration
+	ctx         context.Context
+}
+
+// OpenPlayState constructs a PlayState stored in the file at the specified path, creating the directory containing it
+// if required
+func OpenPlayState(path string, lockTimeout time.Duration) (*PlayState, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("open play state: failed to ensure directory: %w", err)
+	}
+
+	return &PlayState{path: path, lockTimeout: lockTimeout}, nil
+}
+
+// WithContext returns a shallow copy of p that stops waiting for other processes to release the play state when ctx is
+// done
+func (p *PlayState) WithContext(ctx context.Context) *PlayState {
+	c := *p
+	c.ctx = ctx
+
+	return &c
+}
+
+// playKey identifies a track in the play state
+func playKey(t pianobar.Track) string {
+	return fmt.Sprintf("%s\x1f%s\x1f%s", t.Artist, t.Title, t.Album)
+}
+
+// Start records that the specified track started playing at the specified time. pianobar only plays one track at a
+// time, so any other tracks never finished. They are forgotten and returned.
+func (p *PlayState) Start(t pianobar.Track, at time.Time) ([]Play, error) {
+	var orphans []Play
+	err := p.update(func(plays map[string]Play) (map[string]Play, error) {
+		orphans = sortedPlays(plays)
+		return map[string]Play{playKey(t): {Track: t, StartedAt: at}}, nil
+	})
+
+	return orphans, err
+}
+
+// Clear forgets all tracks, returning them
+func (p *PlayState) Clear() ([]Play, error) {
+	var orphans []Play
+	err := p.update(func(plays map[string]Play) (map[string]Play, error) {
+		orphans = sortedPlays(plays)
+		return map[string]Play{}, nil
+	})
+
+	return orphans, err
+}
+
+// sortedPlays returns the specified plays in the order they started
+func sortedPlays(plays map[string]Play) []Play {
+	result := make([]Play, 0, len(plays))
+	for _, play := range plays {
+		result = append(result, play)
+	}
+
+	slices.SortFunc(result, func(a, b Play) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+
+	return result
+}
+
+// IsPlaying returns true iff the specified track started playing and hasn't finished yet
+func (p *PlayState) IsPlaying(t pianobar.Track) (bool, error) {
+	var ok bool
+	err := p.update(func(plays map[string]Play) (map[string]Play, error) {
+		_, ok = plays[playKey(t)]
+		return plays, nil
+	})
+
+	return ok, err
+}
+
+// Finish forgets the specified track, returning the time it started playing. If the track was never started, false is
+// returned.
+func (p *PlayState) Finish(t pianobar.Track) (time.Time, bool, error) {
+	var play Play
+	var ok bool
+	err := p.update(func(plays map[string]Play) (map[string]Play, error) {
+		play, ok = plays[playKey(t)]
+		delete(plays, playKey(t))
+		return plays, nil
+	})
+
+	return play.StartedAt, ok, err
+}
+
+// update locks the play state and calls fn with the current plays, saving the plays it returns
+func (p *PlayState) update(fn func(plays map[string]Play) (map[string]Play, error)) error {
+	ctx := p.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	l, err := flock.Acquire(ctx, p.path+".lock", p.lockTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to lock play state: %w", err)
+	}
+
+	defer func() {
+		_ = l.Release()
+	}()
+
+	plays := map[string]Play{}
+	v, err := os.ReadFile(p.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read play state: %w", err)
+	}
+
+	if len(v) > 0 {
+		if err = json.Unmarshal(v, &plays); err != nil {
+			log.WithError(err).Warn("Play state is corrupt, resetting it")
+			plays = map[string]Play{}
+		}
+	}
+
+	if plays, err = fn(plays); err != nil {
+		return err
+	}
+
+	if v, err = json.Marshal(plays); err != nil {
+		return fmt.Errorf("failed to encode play state: %w", err)
+	}
+
+	if err = os.WriteFile(p.path, v, 0o600); err != nil {
+		return fmt.Errorf("failed to save play state: %w", err)
+	}
+
+	return nil
+}
+
+// startedAt returns the time the specified finished track started playing. If it was never started, it is estimated
+// from how long the track was played.
+func (b Backlog) startedAt(t pianobar.Track) time.Time {
+	at, ok, err := b.Playing.Finish(t)
+	if err != nil {
+		log.WithError(err).Warn("Failed to look up when the track started playing")
+	}
+
+	if !ok {
+		log.Debug("Track start was not recorded, estimating it from how long it was played")
+		return time.Now().Add(-t.SongPlayed).UTC()
+	}
+
+	return at.UTC()
+}
+
+// recoverPlays scrobbles tracks that started playing but never finished, for example because pianobar crashed or the
+// machine went to sleep. Since we don't know how long they were actually played, the time since they started (up to
+// their duration) is used instead. Tracks that meet the requirements for a scrobble are appended to the WAL, marked as
+// recovered, to be scrobbled with the backlog.
+func recoverPlays(handle EventFlags, plays []Play, b Backlog) error {
+	if handle&HandleSongFinish != HandleSongFinish {
+		return nil
+	}
+
+	var err error
+	now := time.Now()
+	for _, play := range plays {
+		t := play.Track
+		t.ScrobbleAt = play.StartedAt.UTC()
+		t.SongPlayed = min(now.Sub(play.StartedAt), t.SongDuration)
+		t.Recovered = true
+
+		log := log.WithFields(logrus.Fields{
+			"artist": t.Artist,
+			"title":  t.Title,
+		})
+
+		if !shouldScrobble(log, handle, t) {
+			log.Debug("Track never finished, and wasn't played long enough to scrobble")
+			continue
+		}
+
+		log.Info("Track never finished, adding it to the WAL to be scrobbled")
+		if appendErr := b.WAL.Append(t); appendErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to append recovered track to WAL: %w", appendErr))
+		}
+	}
+
+	return err
+}
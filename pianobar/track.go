@@ -1,10 +1,8 @@
 package pianobar
 
 import (
-	"bufio"
+	"errors"
 	"io"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -17,48 +15,105 @@ const (
 	keyRating       = "rating"
 )
 
+var (
+	// ErrMissingArtist is returned when a track has no artist
+	ErrMissingArtist = errors.New("track has no artist")
+	// ErrMissingTitle is returned when a track has no title
+	ErrMissingTitle = errors.New("track has no title")
+)
+
+// Rating is the feedback a user has given a track
+type Rating int
+
+const (
+	// RatingNone indicates the user has not rated the track
+	RatingNone Rating = iota
+	// RatingThumbsUp indicates the user has given the track a thumbs-up
+	RatingThumbsUp
+	// RatingThumbsDown indicates the user has given the track a thumbs-down (banned it)
+	RatingThumbsDown
+)
+
+// ratingFromPianobar converts pianobar's rating to a Rating. pianobar uses 1 for loved tracks, 2 for banned tracks
+// and 3 for tracks the user is tired of. We treat tired tracks as un-rated.
+func ratingFromPianobar(v int) Rating {
+	switch v {
+	case 1:
+		return RatingThumbsUp
+	case 2:
+		return RatingThumbsDown
+	default:
+		return RatingNone
+	}
+}
+
+// pianobar converts r back to pianobar's rating
+func (r Rating) pianobar() int {
+	switch r {
+	case RatingThumbsUp:
+		return 1
+	case RatingThumbsDown:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func (r Rating) String() string {
+	switch r {
+	case RatingThumbsUp:
+		return "ThumbsUp"
+	case RatingThumbsDown:
+		return "ThumbsDown"
+	default:
+		return "None"
+	}
+}
+
 type Track struct {
 	Artist string
 	Title  string
 	Album  string
 
-	ThumbsUp bool
+	Rating Rating
 
 	SongDuration time.Duration
 	SongPlayed   time.Duration
 
 	ScrobbleAt time.Time
+
+	// Recovered is true if pianobar never reported that the track finished, and it was scrobbled based on when it
+	// started playing instead
+	Recovered bool `json:",omitempty"`
 }
 
+// TrackFromReader parses the track from the eventcmd payload pianobar writes to stdin. The track must have an artist
+// and title.
 func TrackFromReader(r io.Reader) (Track, error) {
-	lines := bufio.NewScanner(r)
-
-	var result Track
-	result.ScrobbleAt = time.Now().UTC()
-
-	for lines.Scan() {
-		if err := lines.Err(); err != nil {
-			return result, err
-		}
-
-		parts := strings.SplitN(lines.Text(), "=", 2)
-		intPart, _ := strconv.Atoi(parts[1])
-
-		switch parts[0] {
-		case keyArtist:
-			result.Artist = parts[1]
-		case keyTitle:
-			result.Title = parts[1]
-		case keyAlbum:
-			result.Album = parts[1]
-		case keyRating:
-			result.ThumbsUp = parts[1] == "1"
-		case keySongDuration:
-			result.SongDuration = time.Duration(intPart) * time.Second
-		case keySongPlayed:
-			result.SongPlayed = time.Duration(intPart) * time.Second
-		}
+	e, err := EventFromReader(r)
+	if err != nil {
+		return Track{}, err
+	}
+
+	t := e.Track()
+	return t, t.Validate()
+}
+
+// Validate returns an error if t can't be scrobbled because it is missing its artist or title
+func (t Track) Validate() error {
+	var err error
+	if t.Artist == "" {
+		err = errors.Join(err, ErrMissingArtist)
+	}
+
+	if t.Title == "" {
+		err = errors.Join(err, ErrMissingTitle)
 	}
 
-	return result, nil
+	return err
+}
+
+// SameSong returns true iff other refers to the same song as t, regardless of when or how it was played
+func (t Track) SameSong(other Track) bool {
+	return t.Artist == other.Artist && t.Title == other.Title && t.Album == other.Album
 }
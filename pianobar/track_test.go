@@ -31,8 +31,54 @@ detailUrl=https://nlowe.dev/bar.json
 	assert.Equal(t, "Test Artist", sut.Artist)
 	assert.Equal(t, "Test Title with=foo", sut.Title)
 	assert.Equal(t, "Test Album", sut.Album)
-	assert.True(t, sut.ThumbsUp)
+	assert.Equal(t, RatingThumbsUp, sut.Rating)
 
 	assert.EqualValues(t, 456*time.Second, sut.SongDuration)
 	assert.EqualValues(t, 123*time.Second, sut.SongPlayed)
 }
+
+func TestTrackFromReader_Rating(t *testing.T) {
+	for _, tt := range []struct {
+		raw      string
+		expected Rating
+	}{
+		{raw: "0", expected: RatingNone},
+		{raw: "1", expected: RatingThumbsUp},
+		{raw: "2", expected: RatingThumbsDown},
+		{raw: "3", expected: RatingNone},
+	} {
+		t.Run(tt.expected.String()+"/"+tt.raw, func(t *testing.T) {
+			sut, err := TrackFromReader(strings.NewReader("artist=Test Artist\ntitle=Test Title\nrating=" + tt.raw))
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, sut.Rating)
+		})
+	}
+}
+
+func TestTrackFromReader_Invalid(t *testing.T) {
+	t.Run("Missing Artist", func(t *testing.T) {
+		_, err := TrackFromReader(strings.NewReader("artist=\ntitle=Test Title\n"))
+		require.ErrorIs(t, err, ErrMissingArtist)
+		require.NotErrorIs(t, err, ErrMissingTitle)
+	})
+
+	t.Run("Missing Title", func(t *testing.T) {
+		_, err := TrackFromReader(strings.NewReader("artist=Test Artist\ntitle=   \n"))
+		require.ErrorIs(t, err, ErrMissingTitle)
+		require.NotErrorIs(t, err, ErrMissingArtist)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		_, err := TrackFromReader(strings.NewReader("artist=Test Artist\ntitle=Test Title\nsongDuration=long\n"))
+		require.ErrorIs(t, err, ErrMalformedPayload)
+		require.ErrorContains(t, err, "line 3")
+	})
+}
+
+func TestTrack_SameSong(t *testing.T) {
+	sut := Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album", ScrobbleAt: time.Now()}
+
+	assert.True(t, sut.SameSong(Track{Artist: "Test Artist", Title: "Test Title", Album: "Test Album"}))
+	assert.False(t, sut.SameSong(Track{Artist: "Test Artist", Title: "Other Title", Album: "Test Album"}))
+}
@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// tempFileSuffix is appended to the name of files while they are being written
+	tempFileSuffix = ".tmp"
+	// quarantineDirectory is where segments that can't be loaded are moved to
+	quarantineDirectory = "quarantine"
+)
+
+// writeFileAtomic writes data to the file with the specified name in dir such that readers either see
+// the old contents or the new contents, never a partial write. The contents are written to a
+// temporary file, which is synced and renamed over the destination. The directory is synced
+// as well so the rename survives a crash.
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmp := filepath.Join(dir, "."+name+tempFileSuffix)
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err = os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes changes to the directory entries in dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory for sync: %w", err)
+	}
+
+	defer func() {
+		_ = d.Close()
+	}()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+
+	return nil
+}
+
+// isTempFile returns true iff name is a temporary file created by writeFileAtomic
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// quarantine moves the segment with the specified name in root to the quarantine directory, along with its metadata
+// sidecar if it has one
+func quarantine(root, name string) error {
+	dir := filepath.Join(root, quarantineDirectory)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to ensure quarantine directory: %w", err)
+	}
+
+	if err := os.Rename(filepath.Join(root, name), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to quarantine %s: %w", name, err)
+	}
+
+	meta := name + metadataSuffix
+	if err := os.Rename(filepath.Join(root, meta), filepath.Join(dir, meta)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to quarantine %s: %w", meta, err)
+	}
+
+	return syncDir(root)
+}
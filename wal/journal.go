@@ -0,0 +1,394 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nlowe/pianoman/internal/flock"
+)
+
+// Journal is an append-only log of records that have left the WAL, stored as one JSON
+// document per line so it can be reviewed with standard tools. Like the WAL, it may be
+// safely shared by multiple processes.
+type Journal[T any] struct {
+	path string
+	opts options
+	ctx  context.Context
+}
+
+// OpenJournal constructs a Journal stored in the file at the specified path, creating
+// the directory containing it if required. The file itself is created on first append.
+func OpenJournal[T any](path string, opts ...Option) (*Journal[T], error) {
+	j := &Journal[T]{path: path, opts: defaultOptions()}
+	for _, opt := range opts {
+		opt(&j.opts)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("open journal: failed to ensure directory: %w", err)
+	}
+
+	return j, nil
+}
+
+// WithContext returns a shallow copy of j that stops waiting for other processes to
+// release the journal when ctx is done
+func (j *Journal[T]) WithContext(ctx context.Context) *Journal[T] {
+	c := *j
+	c.ctx = ctx
+
+	return &c
+}
+
+// lock takes the lock guarding the journal. The returned function releases the lock.
+func (j *Journal[T]) lock() (func(), error) {
+	ctx := j.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	l, err := flock.Acquire(ctx, j.path+lockFile, j.opts.lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := l.Release(); err != nil {
+			log.WithError(err).Warn("Failed to release journal lock")
+		}
+	}, nil
+}
+
+// Append adds the specified records to the end of the journal with a single write
+func (j *Journal[T]) Append(v ...T) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, record := range v {
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("append to journal: %w", err)
+		}
+	}
+
+	unlock, err := j.lock()
+	if err != nil {
+		return fmt.Errorf("append to journal: %w", err)
+	}
+
+	defer unlock()
+
+	if err = j.repair(); err != nil {
+		return fmt.Errorf("append to journal: %w", err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("append to journal: %w", err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		return fmt.Errorf("append to journal: %w", err)
+	}
+
+	return nil
+}
+
+// repair truncates a torn trailing record so it isn't merged with the next record. The
+// caller must hold the lock.
+func (j *Journal[T]) repair() error {
+	f, err := os.OpenFile(j.path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err = f.ReadAt(last, info.Size()-1); err != nil || last[0] == '\n' {
+		return err
+	}
+
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("journal", j.path).Warn("Truncating torn record")
+	return f.Truncate(int64(bytes.LastIndexByte(raw, '\n') + 1))
+}
+
+// Records reads all records in the journal, in the order they were appended. A torn
+// trailing record and records that can't be decoded are ignored.
+func (j *Journal[T]) Records() ([]T, error) {
+	unlock, err := j.lock()
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+
+	defer unlock()
+
+	result, _, err := j.read()
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+
+	return result, nil
+}
+
+// read reads all records in the journal. Lines that can't be decoded are skipped so they
+// don't prevent the rest of the journal from being used, and are returned separately so
+// they can be quarantined when the journal is rewritten. The caller must hold the lock.
+func (j *Journal[T]) read() ([]T, [][]byte, error) {
+	result := []T{}
+
+	raw, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return result, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var undecodable [][]byte
+	for line := 1; len(raw) > 0; line++ {
+		n := bytes.IndexByte(raw, '\n')
+		if n < 0 {
+			break
+		}
+
+		var v T
+		if err = json.Unmarshal(raw[:n], &v); err != nil {
+			log.WithFields(logrus.Fields{"journal": j.path, "line": line}).WithError(err).Warn("Skipping undecodable record")
+			undecodable = append(undecodable, raw[:n])
+		} else {
+			result = append(result, v)
+		}
+
+		raw = raw[n+1:]
+	}
+
+	return result, undecodable, nil
+}
+
+// Remove removes the records at the specified indices from the journal, returning the removed records in the order
+// they were appended
+func (j *Journal[T]) Remove(indices ...int) ([]T, error) {
+	unlock, err := j.lock()
+	if err != nil {
+		return nil, fmt.Errorf("remove from journal: %w", err)
+	}
+
+	defer unlock()
+
+	records, undecodable, err := j.read()
+	if err != nil {
+		return nil, fmt.Errorf("remove from journal: %w", err)
+	}
+
+	for _, i := range indices {
+		if i < 0 || i >= len(records) {
+			return nil, fmt.Errorf("remove record %d from journal: %w", i, ErrNoSuchRecord)
+		}
+	}
+
+	var removed, kept []T
+	for i, v := range records {
+		if slices.Contains(indices, i) {
+			removed = append(removed, v)
+		} else {
+			kept = append(kept, v)
+		}
+	}
+
+	if err = j.write(kept, undecodable); err != nil {
+		return nil, fmt.Errorf("remove from journal: %w", err)
+	}
+
+	return removed, nil
+}
+
+// Clear removes all records from the journal, returning the number of records removed
+func (j *Journal[T]) Clear() (int, error) {
+	unlock, err := j.lock()
+	if err != nil {
+		return 0, fmt.Errorf("clear journal: %w", err)
+	}
+
+	defer unlock()
+
+	records, undecodable, err := j.read()
+	if err != nil {
+		return 0, fmt.Errorf("clear journal: %w", err)
+	}
+
+	if err = j.write(nil, undecodable); err != nil {
+		return 0, fmt.Errorf("clear journal: %w", err)
+	}
+
+	return len(records), nil
+}
+
+// Process calls fn with the records in the journal, in the order they were appended, and
+// removes the records at the indices it returns. Records appended while fn runs are kept,
+// and records removed by someone else while fn runs are not removed twice. If fn returns an
+// error, the records it returned are still removed. Only one process may process the
+// journal at a time. If another process is already processing it, an error wrapping
+// ErrBusy is returned.
+func (j *Journal[T]) Process(fn func(records []T) ([]int, error)) error {
+	l, err := flock.TryAcquire(j.path + processLockFile)
+	if errors.Is(err, flock.ErrLocked) {
+		return fmt.Errorf("process journal: %w", ErrBusy)
+	}
+
+	if err != nil {
+		return fmt.Errorf("process journal: %w", err)
+	}
+
+	defer func() {
+		if err := l.Release(); err != nil {
+			log.WithError(err).Warn("Failed to release journal process lock")
+		}
+	}()
+
+	records, err := j.Records()
+	if err != nil {
+		return fmt.Errorf("process journal: %w", err)
+	}
+
+	done, err := fn(records)
+	if len(done) > 0 {
+		if removeErr := j.removeProcessed(records, done); removeErr != nil {
+			return errors.Join(err, fmt.Errorf("process journal: %w", removeErr))
+		}
+	}
+
+	return err
+}
+
+// removeProcessed removes the records at the specified indices of processed from the
+// journal. The journal may have changed since processed was read, so records are matched
+// by their contents instead of their position.
+func (j *Journal[T]) removeProcessed(processed []T, indices []int) error {
+	remove := map[string]int{}
+	for _, i := range indices {
+		if i < 0 || i >= len(processed) {
+			return fmt.Errorf("remove record %d: %w", i, ErrNoSuchRecord)
+		}
+
+		raw, err := json.Marshal(processed[i])
+		if err != nil {
+			return err
+		}
+
+		remove[string(raw)]++
+	}
+
+	unlock, err := j.lock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	records, undecodable, err := j.read()
+	if err != nil {
+		return err
+	}
+
+	kept := make([]T, 0, len(records))
+	for _, v := range records {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		if remove[string(raw)] > 0 {
+			remove[string(raw)]--
+			continue
+		}
+
+		kept = append(kept, v)
+	}
+
+	return j.write(kept, undecodable)
+}
+
+// write atomically replaces the contents of the journal with the specified records. Any
+// undecodable lines read from the journal are moved to the quarantine directory next to it
+// first, so they aren't lost. The caller must hold the lock.
+func (j *Journal[T]) write(records []T, undecodable [][]byte) error {
+	if len(undecodable) > 0 {
+		if err := j.quarantine(undecodable); err != nil {
+			return err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, v := range records {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(filepath.Dir(j.path), filepath.Base(j.path), buf.Bytes())
+}
+
+// quarantine appends the specified lines to the file named after the journal in the
+// quarantine directory next to it. The caller must hold the lock.
+func (j *Journal[T]) quarantine(lines [][]byte) error {
+	dir := filepath.Join(filepath.Dir(j.path), quarantineDirectory)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to ensure quarantine directory: %w", err)
+	}
+
+	path := filepath.Join(dir, filepath.Base(j.path))
+	log.WithField("journal", j.path).Warnf("Moving %d undecodable record(s) to %s", len(lines), path)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine undecodable records: %w", err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if _, err = f.Write(append(bytes.Join(lines, []byte{'\n'}), '\n')); err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to quarantine undecodable records: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "journal.jsonl")
+
+	sut, err := OpenJournal[int](path)
+	require.NoError(t, err)
+
+	records, err := sut.Records()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	require.NoError(t, sut.Append(1, 2))
+	require.NoError(t, sut.Append(3))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "1\n2\n3\n", string(contents))
+
+	t.Run("Torn Record", func(t *testing.T) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = f.WriteString("4")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		records, err := sut.Records()
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3}, records)
+
+		require.NoError(t, sut.Append(5))
+
+		records, err = sut.Records()
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3, 5}, records)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		removed, err := sut.Remove(3, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 5}, removed)
+
+		records, err := sut.Records()
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 3}, records)
+
+		_, err = sut.Remove(2)
+		require.ErrorIs(t, err, ErrNoSuchRecord)
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		n, err := sut.Clear()
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		records, err := sut.Records()
+		require.NoError(t, err)
+		assert.Empty(t, records)
+	})
+
+	t.Run("Process", func(t *testing.T) {
+		require.NoError(t, sut.Append(5, 6, 7))
+
+		require.NoError(t, sut.Process(func(records []int) ([]int, error) {
+			assert.Equal(t, []int{5, 6, 7}, records)
+
+			// Processing the journal from somewhere else should fail while we're processing it
+			require.ErrorIs(t, sut.Process(func([]int) ([]int, error) {
+				t.Error("journal should not have been processed twice")
+				return nil, nil
+			}), ErrBusy)
+
+			// Records appended while processing should be kept
+			require.NoError(t, sut.Append(8))
+
+			return []int{0, 2}, nil
+		}))
+
+		records, err := sut.Records()
+		require.NoError(t, err)
+		assert.Equal(t, []int{6, 8}, records)
+	})
+
+	t.Run("Process Concurrent Remove", func(t *testing.T) {
+		_, err := sut.Clear()
+		require.NoError(t, err)
+		require.NoError(t, sut.Append(1, 2, 3, 3))
+
+		require.NoError(t, sut.Process(func(records []int) ([]int, error) {
+			assert.Equal(t, []int{1, 2, 3, 3}, records)
+
+			// Someone else removes a record while we're processing, shifting the rest
+			_, err := sut.Remove(0)
+			require.NoError(t, err)
+
+			return []int{0, 2}, nil
+		}))
+
+		records, err := sut.Records()
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 3}, records)
+	})
+}
+
+func TestJournal_Undecodable(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "journal.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("1\n\"two\"\n3\n"), 0600))
+
+	sut, err := OpenJournal[int](path)
+	require.NoError(t, err)
+
+	records, err := sut.Records()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, records)
+
+	removed, err := sut.Remove(0)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, removed)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "3\n", string(contents))
+
+	contents, err = os.ReadFile(filepath.Join(root, quarantineDirectory, "journal.jsonl"))
+	require.NoError(t, err)
+	assert.Equal(t, "\"two\"\n", string(contents))
+}
@@ -0,0 +1,142 @@
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// metadataSuffix is appended to the ID of a segment to get the name of its metadata sidecar
+const metadataSuffix = ".meta"
+
+// Metadata is the retry bookkeeping for a segment, stored in a sidecar file next to the segment
+type Metadata struct {
+	// Attempts is the number of times processing the segment has failed
+	Attempts int `json:"attempts"`
+	// LastError is the error from the last failed attempt
+	LastError string `json:"lastError,omitempty"`
+	// NextAttempt is the earliest time the segment should be processed again
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// Due returns true iff the segment may be processed at the specified time
+func (m Metadata) Due(now time.Time) bool {
+	return !now.Before(m.NextAttempt)
+}
+
+// backoff returns how long to wait before processing a segment again after the specified number of failed attempts.
+// The delay doubles with each attempt up to the configured cap, if any, and is jittered so processes sharing a WAL
+// don't retry in lockstep.
+func (o options) backoff(attempts int) time.Duration {
+	if o.backoffInitial <= 0 {
+		return 0
+	}
+
+	d := o.backoffInitial
+	for i := 1; i < attempts; i++ {
+		if o.backoffMax > 0 && d >= o.backoffMax {
+			break
+		}
+
+		if d > math.MaxInt64/2 {
+			// Doubling again would overflow
+			d = math.MaxInt64
+			break
+		}
+
+		d *= 2
+	}
+
+	if o.backoffMax > 0 {
+		d = min(d, o.backoffMax)
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (w *WAL[T]) metadataPath(id ulid.ULID) string {
+	return filepath.Join(w.root, id.String()+metadataSuffix)
+}
+
+// readMetadata reads the metadata sidecar for the segment with the specified ID. Segments without a sidecar have
+// never failed. The caller must hold the lock.
+func (w *WAL[T]) readMetadata(id ulid.ULID) Metadata {
+	var result Metadata
+
+	raw, err := os.ReadFile(w.metadataPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return result
+	}
+
+	if err == nil {
+		err = json.Unmarshal(raw, &result)
+	}
+
+	if err != nil {
+		log.WithField("segment", id.String()).WithError(err).Warn("Ignoring unreadable segment metadata")
+		return Metadata{}
+	}
+
+	return result
+}
+
+// fail records a failed attempt to process the specified segment and schedules the next attempt. The caller must hold
+// the lock.
+func (w *WAL[T]) fail(s *Segment[T], reason string) error {
+	s.meta.Attempts++
+	s.meta.LastError = reason
+
+	delay := w.opts.backoff(s.meta.Attempts)
+	s.meta.NextAttempt = time.Now().Add(delay)
+
+	log.WithField("segment", s.id.String()).Debugf("Attempt %d failed, retrying in %s", s.meta.Attempts, delay.Round(time.Second))
+
+	raw, err := json.Marshal(s.meta)
+	if err != nil {
+		return fmt.Errorf("failed to serialize segment metadata: %w", err)
+	}
+
+	if err = writeFileAtomic(w.root, s.id.String()+metadataSuffix, raw); err != nil {
+		return fmt.Errorf("failed to write segment metadata: %w", err)
+	}
+
+	return nil
+}
+
+// removeMetadata removes the metadata sidecar for the segment with the specified ID, if any. The caller must hold the
+// lock.
+func (w *WAL[T]) removeMetadata(id ulid.ULID) {
+	if err := os.Remove(w.metadataPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.WithField("segment", id.String()).WithError(err).Warn("Failed to remove segment metadata")
+	}
+}
+
+// ResetBackoff clears the retry bookkeeping for all segments, so they are processed on the next call to Process
+// regardless of when they last failed
+func (w *WAL[T]) ResetBackoff() error {
+	unlock, err := w.lock()
+	if err != nil {
+		return fmt.Errorf("reset backoff: %w", err)
+	}
+
+	defer unlock()
+
+	ids, err := w.list()
+	if err != nil {
+		return fmt.Errorf("reset backoff: %w", err)
+	}
+
+	for _, id := range ids {
+		w.removeMetadata(id)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package wal
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nlowe/pianoman/lastfm"
+)
+
+func TestOptions_backoff(t *testing.T) {
+	sut := options{backoffInitial: time.Minute, backoffMax: 5 * time.Minute}
+
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Minute},
+		{attempts: 2, want: 2 * time.Minute},
+		{attempts: 3, want: 4 * time.Minute},
+		{attempts: 4, want: 5 * time.Minute},
+		{attempts: 100, want: 5 * time.Minute},
+	} {
+		t.Run(fmt.Sprintf("%d Attempts", tt.attempts), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := sut.backoff(tt.attempts)
+				require.GreaterOrEqual(t, d, tt.want/2)
+				require.LessOrEqual(t, d, tt.want)
+			}
+		})
+	}
+
+	t.Run("Uncapped", func(t *testing.T) {
+		sut := options{backoffInitial: time.Minute, backoffMax: 0}
+
+		for _, tt := range []struct {
+			attempts int
+			want     time.Duration
+		}{
+			{attempts: 1, want: time.Minute},
+			{attempts: 3, want: 4 * time.Minute},
+			{attempts: 10, want: 512 * time.Minute},
+			{attempts: 1000, want: math.MaxInt64},
+		} {
+			d := sut.backoff(tt.attempts)
+			require.GreaterOrEqual(t, d, tt.want/2, "%d attempts", tt.attempts)
+			require.LessOrEqual(t, d, tt.want, "%d attempts", tt.attempts)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert.Zero(t, options{}.backoff(3))
+	})
+}
+
+func TestWAL_Backoff(t *testing.T) {
+	root := t.TempDir()
+
+	sut, err := Open[int](root, lastfm.MaxTracksPerScrobble, WithBackoff(time.Hour, 2*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, sut.Append(1))
+
+	var visits int
+	visit := func(segment Segment[int]) ([]Result, error) {
+		visits++
+		return nil, fmt.Errorf("dummy")
+	}
+
+	require.ErrorContains(t, sut.Process(visit), "dummy")
+	require.Equal(t, 1, visits)
+
+	result := segments(t, sut)
+	require.Len(t, result, 1)
+
+	meta := result[0].Metadata()
+	assert.Equal(t, 1, meta.Attempts)
+	assert.Equal(t, "dummy", meta.LastError)
+	assert.WithinRange(t, meta.NextAttempt, time.Now().Add(29*time.Minute), time.Now().Add(time.Hour))
+	assert.FileExists(t, filepath.Join(root, result[0].ID().String()+metadataSuffix))
+
+	// The segment isn't due yet, so it should be skipped
+	require.NoError(t, sut.Process(visit))
+	require.Equal(t, 1, visits)
+
+	t.Run("Skipped", func(t *testing.T) {
+		require.NoError(t, sut.ResetBackoff())
+		err := sut.Process(func(segment Segment[int]) ([]Result, error) {
+			return nil, fmt.Errorf("offline: %w", ErrSkipped)
+		})
+		require.ErrorIs(t, err, ErrSkipped)
+
+		assert.Zero(t, segments(t, sut)[0].Metadata())
+	})
+
+	t.Run("Retry Results", func(t *testing.T) {
+		require.NoError(t, sut.ResetBackoff())
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			return []Result{{Outcome: Retry, Reason: "later"}}, nil
+		}))
+
+		meta := segments(t, sut)[0].Metadata()
+		assert.Equal(t, 1, meta.Attempts)
+		assert.Equal(t, "later", meta.LastError)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		require.NoError(t, sut.ResetBackoff())
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			return nil, nil
+		}))
+
+		assert.True(t, sut.Empty())
+		assert.NoFileExists(t, filepath.Join(root, result[0].ID().String()+metadataSuffix))
+	})
+}
@@ -0,0 +1,39 @@
+package wal
+
+import "time"
+
+// DefaultLockTimeout is how long WAL operations wait for other processes to release the WAL by default
+const DefaultLockTimeout = 10 * time.Second
+
+type options struct {
+	lockTimeout time.Duration
+
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+}
+
+func defaultOptions() options {
+	return options{
+		lockTimeout: DefaultLockTimeout,
+	}
+}
+
+// Option configures optional behavior of a WAL
+type Option func(o *options)
+
+// WithLockTimeout sets how long WAL operations wait for other processes to release the WAL before failing
+func WithLockTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.lockTimeout = d
+	}
+}
+
+// WithBackoff sets how long Process waits before retrying a segment that failed to process. The delay starts at initial
+// and doubles with each failed attempt up to maxDelay. By default, or with an initial delay of zero, segments are
+// retried immediately.
+func WithBackoff(initial, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.backoffInitial = initial
+		o.backoffMax = maxDelay
+	}
+}
@@ -0,0 +1,32 @@
+package wal
+
+// Outcome describes what happened to a record when it was processed
+type Outcome int
+
+const (
+	// Accepted records were processed successfully and are removed from the WAL
+	Accepted Outcome = iota
+	// Ignored records were processed but will never succeed, so they are removed from the WAL
+	Ignored
+	// Retry records could not be processed and are kept in the WAL to be processed again later
+	Retry
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Accepted:
+		return "accepted"
+	case Ignored:
+		return "ignored"
+	case Retry:
+		return "retry"
+	default:
+		return "unknown"
+	}
+}
+
+// Result is the outcome of processing a single record, and an optional reason for that outcome
+type Result struct {
+	Outcome Outcome
+	Reason  string
+}
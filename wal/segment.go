@@ -1,9 +1,13 @@
 package wal
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"slices"
+	"time"
 
 	"github.com/oklog/ulid"
 )
@@ -11,26 +15,153 @@ import (
 // Segment is a collection of records that exist in the WAL, in the order they were
 // appended. The WAL will append a maximum of maxSegmentSize records to a segment
 // before cutting a new one.
+//
+// Segments are stored on disk as one record per line. Each line is the CRC-32C of the
+// JSON representation of the record in hex, followed by a space and the record itself,
+// so records can be appended with a single write and a torn trailing record can be
+// detected.
 type Segment[T any] struct {
 	id      ulid.ULID
 	records []T
+
+	// size is the number of bytes on disk that contain complete records
+	size int64
+	// legacy is true if the segment was loaded from a format that can't be appended to
+	legacy bool
+
+	meta Metadata
+}
+
+// segmentFile is the checksummed envelope segments were stored in before the line-delimited
+// format was introduced. The checksum is the CRC-32C of the compacted JSON representation of
+// the records.
+type segmentFile struct {
+	Checksum string          `json:"checksum"`
+	Records  json.RawMessage `json:"records"`
 }
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum computes the checksum of the specified JSON document
+func checksum(v json.RawMessage) (string, error) {
+	compacted := &bytes.Buffer{}
+	if err := json.Compact(compacted, v); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%08x", crc32.Checksum(compacted.Bytes(), crcTable)), nil
+}
+
+// loadSegment parses a segment. A torn trailing record is ignored, and the size of the
+// segment only covers complete records so the caller can truncate the file. Segments
+// written before the line-delimited format was introduced are either a plain JSON array
+// of records or a checksummed envelope, and are marked as legacy so they can be migrated.
 func loadSegment[T any](id ulid.ULID, r io.Reader) (Segment[T], error) {
 	result := Segment[T]{
 		id: id,
 	}
 
-	if err := json.NewDecoder(r).Decode(&result.records); err != nil {
-		return result, fmt.Errorf("failed to parse WAL segment: %w", err)
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return result, fmt.Errorf("failed to read WAL segment: %w", err)
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	switch {
+	case len(trimmed) == 0:
+		return result, nil
+	case trimmed[0] == '[':
+		result.legacy = true
+		if err = json.Unmarshal(raw, &result.records); err != nil {
+			return result, fmt.Errorf("failed to parse WAL segment: %w", err)
+		}
+
+		return result, nil
+	case trimmed[0] == '{':
+		result.legacy = true
+
+		var f segmentFile
+		if err = json.Unmarshal(raw, &f); err != nil {
+			return result, fmt.Errorf("failed to parse WAL segment: %w", err)
+		}
+
+		sum, err := checksum(f.Records)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse WAL segment: %w", err)
+		}
+
+		if sum != f.Checksum {
+			return result, fmt.Errorf("failed to parse WAL segment: %w: want %s, got %s", ErrChecksumMismatch, f.Checksum, sum)
+		}
+
+		if err = json.Unmarshal(f.Records, &result.records); err != nil {
+			return result, fmt.Errorf("failed to parse WAL segment: %w", err)
+		}
+
+		return result, nil
+	}
+
+	// Records are written with a single write that ends in a newline, so a trailing record without
+	// one was interrupted
+	for len(raw) > 0 {
+		n := bytes.IndexByte(raw, '\n')
+		if n < 0 {
+			break
+		}
+
+		var v T
+		if err = decodeRecord(raw[:n], &v); err != nil {
+			return result, fmt.Errorf("failed to parse WAL segment: record %d: %w", len(result.records), err)
+		}
+
+		result.records = append(result.records, v)
+		result.size += int64(n + 1)
+		raw = raw[n+1:]
 	}
 
 	return result, nil
 }
 
+// encodeRecord encodes the specified value as a line in a segment
+func encodeRecord[T any](v T) ([]byte, error) {
+	record, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize WAL record: %w", err)
+	}
+
+	return fmt.Appendf(nil, "%08x %s\n", crc32.Checksum(record, crcTable), record), nil
+}
+
+// decodeRecord decodes a line from a segment, without the trailing newline, into v
+func decodeRecord[T any](line []byte, v *T) error {
+	want, record, ok := bytes.Cut(line, []byte{' '})
+	if !ok {
+		return fmt.Errorf("%w: missing checksum", ErrChecksumMismatch)
+	}
+
+	sum := fmt.Sprintf("%08x", crc32.Checksum(record, crcTable))
+	if sum != string(want) {
+		return fmt.Errorf("%w: want %s, got %s", ErrChecksumMismatch, want, sum)
+	}
+
+	return json.Unmarshal(record, v)
+}
+
 func (s *Segment[T]) serialize(w io.Writer) error {
 	log.WithField("segment", s.id.String()).Tracef("Serializing Segment of size %d", s.Length())
-	return json.NewEncoder(w).Encode(s.records)
+
+	for _, v := range s.records {
+		record, err := encodeRecord(v)
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write(record); err != nil {
+			return fmt.Errorf("failed to serialize WAL segment: %w", err)
+		}
+	}
+
+	return nil
 }
 
 func (s *Segment[T]) append(v T) {
@@ -38,6 +169,47 @@ func (s *Segment[T]) append(v T) {
 	s.records = append(s.records, v)
 }
 
+// remove removes any records matching the specified predicate, returning the number of records removed
+func (s *Segment[T]) remove(match func(v T) bool) int {
+	before := len(s.records)
+	s.records = slices.DeleteFunc(s.records, match)
+
+	removed := before - len(s.records)
+	if removed > 0 {
+		log.WithField("segment", s.id.String()).Tracef("Removed %d record(s)", removed)
+	}
+
+	return removed
+}
+
+// removeLast removes the last record matching the specified predicate, returning true if a record was removed
+func (s *Segment[T]) removeLast(match func(v T) bool) bool {
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if match(s.records[i]) {
+			log.WithField("segment", s.id.String()).Tracef("Removed record %d", i)
+			s.records = slices.Delete(s.records, i, i+1)
+			return true
+		}
+	}
+
+	return false
+}
+
+// ID returns the ID of the segment
+func (s *Segment[T]) ID() ulid.ULID {
+	return s.id
+}
+
+// CreatedAt returns the time the segment was created, which is embedded in its ID
+func (s *Segment[T]) CreatedAt() time.Time {
+	return ulid.Time(s.id.Time())
+}
+
+// Metadata returns the retry bookkeeping for the segment
+func (s *Segment[T]) Metadata() Metadata {
+	return s.meta
+}
+
 func (s *Segment[T]) Length() int {
 	return len(s.records)
 }
@@ -12,7 +12,7 @@ import (
 func TestSegment(t *testing.T) {
 	t.Run("loadSegment", func(t *testing.T) {
 		t.Run("success", func(t *testing.T) {
-			src := strings.NewReader(`[1,2,3]`)
+			src := strings.NewReader("90f599e3 1\n83a56a17 2\n71cee914 3\n")
 
 			id := ulid.MustNew(ulid.Now(), ulidEntropySource)
 			sut, err := loadSegment[int](id, src)
@@ -25,13 +25,60 @@ func TestSegment(t *testing.T) {
 			assert.Equal(t, 1, records[0])
 			assert.Equal(t, 2, records[1])
 			assert.Equal(t, 3, records[2])
+
+			assert.EqualValues(t, 33, sut.size, "size")
+			assert.False(t, sut.legacy, "legacy")
+		})
+
+		t.Run("torn record", func(t *testing.T) {
+			src := strings.NewReader("90f599e3 1\n83a56a17 2\n71ce")
+
+			sut, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), src)
+			require.NoError(t, err)
+
+			assert.Equal(t, []int{1, 2}, sut.Records())
+			assert.EqualValues(t, 22, sut.size, "size")
+		})
+
+		t.Run("corrupt record", func(t *testing.T) {
+			src := strings.NewReader("90f599e3 1\n83a56a17 4\n71cee914 3\n")
+
+			_, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), src)
+			require.ErrorIs(t, err, ErrChecksumMismatch)
+		})
+
+		t.Run("legacy", func(t *testing.T) {
+			src := strings.NewReader(`[1,2,3]`)
+
+			sut, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), src)
+			require.NoError(t, err)
+
+			assert.Equal(t, []int{1, 2, 3}, sut.Records())
+			assert.True(t, sut.legacy, "legacy")
 		})
 
 		t.Run("error", func(t *testing.T) {
-			_, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), strings.NewReader("definitely not json"))
+			_, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), strings.NewReader("definitely not json\n"))
 
 			require.ErrorContains(t, err, "failed to parse WAL segment:")
 		})
+
+		t.Run("legacy checksum", func(t *testing.T) {
+			src := strings.NewReader(`{"checksum":"63f19980","records":[1,2,3]}`)
+
+			sut, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), src)
+			require.NoError(t, err)
+
+			assert.Equal(t, []int{1, 2, 3}, sut.Records())
+			assert.True(t, sut.legacy, "legacy")
+		})
+
+		t.Run("legacy checksum mismatch", func(t *testing.T) {
+			src := strings.NewReader(`{"checksum":"63f19980","records":[1,2,4]}`)
+
+			_, err := loadSegment[int](ulid.MustNew(ulid.Now(), ulidEntropySource), src)
+			require.ErrorIs(t, err, ErrChecksumMismatch)
+		})
 	})
 
 	t.Run("serialize", func(t *testing.T) {
@@ -40,7 +87,7 @@ func TestSegment(t *testing.T) {
 		buff := &strings.Builder{}
 		require.NoError(t, sut.serialize(buff))
 
-		assert.Equal(t, "[1,2,3]\n", buff.String())
+		assert.Equal(t, "90f599e3 1\n83a56a17 2\n71cee914 3\n", buff.String())
 	})
 
 	t.Run("append", func(t *testing.T) {
@@ -55,4 +102,14 @@ func TestSegment(t *testing.T) {
 		records := sut.Records()
 		assert.Equal(t, 4, records[3])
 	})
+
+	t.Run("remove", func(t *testing.T) {
+		sut := Segment[int]{records: []int{1, 2, 3, 4}}
+
+		assert.Equal(t, 2, sut.remove(func(v int) bool {
+			return v%2 == 0
+		}))
+
+		assert.Equal(t, []int{1, 3}, sut.Records())
+	})
 }
@@ -1,19 +1,40 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/oklog/ulid"
+
+	"github.com/nlowe/pianoman/internal/flock"
 )
 
 var log = logrus.WithField("prefix", "wal")
 
+var (
+	// ErrNoSuchSegment is returned when a segment does not exist in the WAL
+	ErrNoSuchSegment = errors.New("no such segment")
+	// ErrNoSuchRecord is returned when a record does not exist in a segment
+	ErrNoSuchRecord = errors.New("no such record")
+	// ErrBusy is returned when the WAL or a journal is already being processed by another process
+	ErrBusy = errors.New("WAL is being processed by another process")
+	// ErrChecksumMismatch is returned when a segment's contents do not match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrSkipped may be wrapped by errors returned from a Process visitor to stop processing without counting it as a
+	// failed attempt, for example because the segment was never sent anywhere
+	ErrSkipped = errors.New("segment skipped")
+)
+
 var ulidEntropySource = ulid.Monotonic(
 	// We don't have to be cryptographically secure, and each scrobble should yield at most
 	// one new segment, so using math/rand is fine here.
@@ -21,39 +42,119 @@ var ulidEntropySource = ulid.Monotonic(
 	0,
 )
 
+const (
+	// lockFile guards reading and writing segments
+	lockFile = ".lock"
+	// processLockFile is held while segments are being processed
+	processLockFile = ".process.lock"
+)
+
 // WAL is a simple write-ahead-log like structure containing multiple records. It is
 // rooted at a specific directory, which contains WAL segments as files. Each file is
 // named with a ULID for the segment based on the timestamp the segment was created.
 // Segments contain a maximum of maxSegmentSize records, and segments are automatically
 // added as new records are appended to the log, as well as removed as segments are
 // successfully processed.
+//
+// Segments are read from disk only when they are needed, so the cost of appending to
+// the WAL does not depend on the size of the backlog. Multiple processes may safely use
+// the same WAL. Each operation takes an advisory lock on the WAL directory and re-lists
+// segments before making any changes.
 type WAL[T any] struct {
-	root     string
-	segments []*Segment[T]
+	root string
+	// tail is the last segment appended to by this process, if any
+	tail *Segment[T]
 
 	maxSegmentSize int
+	opts           options
+
+	// ctx stops waiting for other processes to release the WAL when it is done, if set
+	ctx context.Context
 }
 
-// Open constructs a new WAL by loading segments from the specified directory. Directories
-// and files that are not named with a valid ULID are ignored. Each segment is loaded
-// in order based on the timestamp the segment was created, which is embedded in the ID
-// of the segment.
-func Open[T any](path string, maxSegmentSize int) (WAL[T], error) {
+// Open constructs a new WAL rooted at the specified directory. Directories and files
+// that are not named with a valid ULID are ignored. Segments are processed in order
+// based on the timestamp the segment was created, which is embedded in the ID of the
+// segment. Segments are not read until they are needed.
+func Open[T any](path string, maxSegmentSize int, opts ...Option) (*WAL[T], error) {
 	log.Debugf("Opening wal at '%s' with max segment size %d", path, maxSegmentSize)
-	w := WAL[T]{root: path, maxSegmentSize: maxSegmentSize}
+	w := &WAL[T]{root: path, maxSegmentSize: maxSegmentSize, opts: defaultOptions()}
+	for _, opt := range opts {
+		opt(&w.opts)
+	}
 
 	// Ensure the WAL directory exists
 	if err := os.MkdirAll(w.root, 0700); err != nil {
-		return w, fmt.Errorf("open WAL: failed to ensure WAL directory: %w", err)
+		return nil, fmt.Errorf("open WAL: failed to ensure WAL directory: %w", err)
+	}
+
+	unlock, err := w.lock()
+	if err != nil {
+		return nil, fmt.Errorf("open WAL: %w", err)
 	}
 
-	// Get a listing of the WAL directory contents
-	files, err := os.ReadDir(path)
+	defer unlock()
+
+	// Clean up after any writes that were interrupted
+	files, err := os.ReadDir(w.root)
 	if err != nil {
-		return w, fmt.Errorf("open WAL: failed to list WAL segments: %w", err)
+		return nil, fmt.Errorf("open WAL: failed to list WAL directory: %w", err)
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && isTempFile(file.Name()) {
+			log.Warnf("Removing incomplete write %s", file.Name())
+			_ = os.Remove(filepath.Join(w.root, file.Name()))
+		}
+	}
+
+	return w, nil
+}
+
+// WithContext returns a shallow copy of w that stops waiting for other processes to release
+// the WAL when ctx is done. Process always waits to record the outcome of a segment, since
+// its records may have already been sent.
+func (w *WAL[T]) WithContext(ctx context.Context) *WAL[T] {
+	c := *w
+	c.ctx = ctx
+
+	return &c
+}
+
+// lock takes the lock guarding the WAL directory. The returned function releases the lock.
+func (w *WAL[T]) lock() (func(), error) {
+	ctx := w.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return w.lockContext(ctx)
+}
+
+// lockContext takes the lock guarding the WAL directory, waiting until ctx is done at most.
+// The returned function releases the lock.
+func (w *WAL[T]) lockContext(ctx context.Context) (func(), error) {
+	l, err := flock.Acquire(ctx, filepath.Join(w.root, lockFile), w.opts.lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := l.Release(); err != nil {
+			log.WithError(err).Warn("Failed to release WAL lock")
+		}
+	}, nil
+}
+
+// list returns the IDs of all segments on disk, in order. The caller must hold the lock.
+func (w *WAL[T]) list() ([]ulid.ULID, error) {
+	files, err := os.ReadDir(w.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
 	}
 
 	// ULIDs are already in order and os.ReadDir returns the listing in order
+	ids := make([]ulid.ULID, 0, len(files))
 	for _, file := range files {
 		// Skip directories, we only care about files
 		if file.IsDir() {
@@ -66,80 +167,680 @@ func Open[T any](path string, maxSegmentSize int) (WAL[T], error) {
 			continue
 		}
 
-		// Open and load the segment
-		log := log.WithField("segment", file.Name())
-		log.Trace("Opening Segment")
-		f, err := os.OpenFile(filepath.Join(w.root, file.Name()), os.O_RDONLY|os.O_SYNC, 0600)
-		if err != nil {
-			return w, fmt.Errorf("open WAL: failed to open segment %s: %w", id.String(), err)
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// read reads the segment with the specified ID from disk. Segments that can't be read are
+// moved to the quarantine directory so they don't prevent the rest of the WAL from being
+// processed, and segments without any records are removed. In both cases, nil is returned.
+// The caller must hold the lock.
+func (w *WAL[T]) read(id ulid.ULID) (*Segment[T], error) {
+	log := log.WithField("segment", id.String())
+	log.Trace("Opening Segment")
+
+	segment, err := w.loadSegment(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read segment %s: %w", id.String(), ErrNoSuchSegment)
+	}
+
+	if err != nil {
+		log.WithError(err).Warnf("Moving unreadable segment to %s", filepath.Join(w.root, quarantineDirectory))
+		if err = quarantine(w.root, id.String()); err != nil {
+			log.WithError(err).Error("Failed to quarantine segment, ignoring it")
+		}
+
+		return nil, nil
+	}
+
+	if segment.Length() == 0 {
+		log.Debug("Removing empty segment")
+		_ = os.Remove(filepath.Join(w.root, id.String()))
+		return nil, nil
+	}
+
+	segment.meta = w.readMetadata(id)
+
+	log.Tracef("Segment has %d entries", segment.Length())
+	return segment, nil
+}
+
+// loadSegment reads the segment with the specified ID from disk
+func (w *WAL[T]) loadSegment(id ulid.ULID) (*Segment[T], error) {
+	f, err := os.OpenFile(filepath.Join(w.root, id.String()), os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %s: %w", id.String(), err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	segment, err := loadSegment[T](id, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load segment %s: %w", id.String(), err)
+	}
+
+	if segment.legacy {
+		log.WithField("segment", id.String()).Debug("Migrating segment to line-delimited format")
+		if err = w.commit(&segment); err != nil {
+			return nil, fmt.Errorf("failed to migrate segment %s: %w", id.String(), err)
 		}
 
-		segment, err := loadSegment[T](id, f)
+		return &segment, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat segment %s: %w", id.String(), err)
+	}
+
+	if info.Size() > segment.size {
+		log.WithField("segment", id.String()).Warnf("Truncating torn record at offset %d", segment.size)
+		if err = os.Truncate(f.Name(), segment.size); err != nil {
+			return nil, fmt.Errorf("failed to truncate segment %s: %w", id.String(), err)
+		}
+	}
+
+	return &segment, nil
+}
+
+// processing returns true iff segments are currently being processed, by this or any other process
+func (w *WAL[T]) processing() bool {
+	l, err := flock.TryAcquire(filepath.Join(w.root, processLockFile))
+	if err != nil {
+		return errors.Is(err, flock.ErrLocked)
+	}
+
+	_ = l.Release()
+	return false
+}
+
+// Empty returns true iff the WAL does not contain any segments. If the WAL directory
+// can't be listed, it is assumed not to be empty.
+func (w *WAL[T]) Empty() bool {
+	unlock, err := w.lock()
+	if err != nil {
+		return false
+	}
+
+	defer unlock()
+
+	ids, err := w.list()
+	return err == nil && len(ids) == 0
+}
+
+// Segments reads all segments in the WAL, in order. Modifying the returned segments does
+// not modify the WAL. Segments is read-only: segments that can't be read are reported and
+// skipped, and are only repaired or quarantined the next time the WAL is written or
+// processed.
+func (w *WAL[T]) Segments() ([]Segment[T], error) {
+	unlock, err := w.lock()
+	if err != nil {
+		return nil, fmt.Errorf("list segments: %w", err)
+	}
+
+	defer unlock()
+
+	ids, err := w.list()
+	if err != nil {
+		return nil, fmt.Errorf("list segments: %w", err)
+	}
+
+	result := make([]Segment[T], 0, len(ids))
+	for _, id := range ids {
+		segment, err := w.peek(id)
 		if err != nil {
-			return w, fmt.Errorf("open WAL: failed to load segment %s: %w", id.String(), err)
+			// It's quarantined the next time it's read for writing or processing
+			log.WithField("segment", id.String()).WithError(err).Warn("Skipping unreadable segment")
+			continue
 		}
 
-		log.Tracef("Segment has %d entries", segment.Length())
-		w.segments = append(w.segments, &segment)
+		if segment.Length() > 0 {
+			result = append(result, *segment)
+		}
 	}
 
-	return w, nil
+	return result, nil
 }
 
-// Append adds the specified value to the WAL, creating a new segment if required. Once
-// the record is appended to the tail of the WAL, the segment containing it is committed
-// to disk.
+// peek reads the segment with the specified ID from disk like read, without repairing or
+// removing it. The caller must hold the lock.
+func (w *WAL[T]) peek(id ulid.ULID) (*Segment[T], error) {
+	f, err := os.OpenFile(filepath.Join(w.root, id.String()), os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %s: %w", id.String(), err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	segment, err := loadSegment[T](id, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load segment %s: %w", id.String(), err)
+	}
+
+	if info, err := f.Stat(); err == nil && !segment.legacy && info.Size() > segment.size {
+		log.WithField("segment", id.String()).Warnf("Ignoring torn record at offset %d", segment.size)
+	}
+
+	segment.meta = w.readMetadata(id)
+	return &segment, nil
+}
+
+// Append adds the specified value to the WAL, creating a new segment if required. The
+// record is written to the end of the tail segment on disk before Append returns.
 func (w *WAL[T]) Append(v T) error {
-	// Create a segment if we don't have any or the current tail segment is out of space
-	if len(w.segments) == 0 || w.segments[len(w.segments)-1].Length() >= w.maxSegmentSize {
+	unlock, err := w.lock()
+	if err != nil {
+		return fmt.Errorf("failed to commit append: %w", err)
+	}
+
+	defer unlock()
+
+	tail, err := w.tailSegment()
+	if err != nil {
+		return fmt.Errorf("failed to commit append: %w", err)
+	}
+
+	// Create a segment if we don't have any or the current tail segment is out of space. If
+	// segments are being processed, the tail may be processed and trimmed at any time, so we
+	// can't safely append to it either.
+	if tail == nil || tail.Length() >= w.maxSegmentSize || w.processing() {
 		id := ulid.MustNew(ulid.Now(), ulidEntropySource)
 		log.Tracef("Creating new segment %s", id.String())
-		w.segments = append(w.segments, &Segment[T]{
+		tail = &Segment[T]{
 			id: id,
-		})
+		}
 	}
 
-	tail := w.segments[len(w.segments)-1]
+	w.tail = nil
+	if err := w.appendRecord(tail, v); err != nil {
+		return fmt.Errorf("failed to commit append: %w", err)
+	}
 
-	tail.append(v)
+	w.tail = tail
+	return nil
+}
+
+// tailSegment returns the last segment in the WAL, or nil if the WAL is empty. The segment
+// is only read from disk if it was changed since this process last appended to it. The
+// caller must hold the lock.
+func (w *WAL[T]) tailSegment() (*Segment[T], error) {
+	ids, err := w.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		if w.tail != nil && w.tail.id == ids[i] {
+			info, err := os.Stat(filepath.Join(w.root, ids[i].String()))
+			if err == nil && info.Size() == w.tail.size {
+				return w.tail, nil
+			}
+		}
+
+		tail, err := w.read(ids[i])
+		if err != nil || tail != nil {
+			return tail, err
+		}
+	}
+
+	return nil, nil
+}
+
+// commit atomically rewrites the specified segment on disk
+func (w *WAL[T]) commit(s *Segment[T]) error {
+	buf := &bytes.Buffer{}
+	if err := s.serialize(buf); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(w.root, s.id.String(), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write WAL Segment: %w", err)
+	}
+
+	s.size = int64(buf.Len())
+	s.legacy = false
+	return nil
+}
 
-	f, err := os.OpenFile(filepath.Join(w.root, tail.id.String()), os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_SYNC, 0600)
+// appendRecord appends the specified value to the segment on disk with a single write, creating
+// the segment if it does not exist yet. If the write fails, the segment is truncated to remove any
+// partially written record.
+func (w *WAL[T]) appendRecord(s *Segment[T], v T) error {
+	record, err := encodeRecord(v)
 	if err != nil {
-		return fmt.Errorf("failed to commit append: failed to open WAL Segment: %w", err)
+		return err
+	}
+
+	path := filepath.Join(w.root, s.id.String())
+	_, err = os.Stat(path)
+	created := errors.Is(err, fs.ErrNotExist)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL Segment: %w", err)
 	}
 
 	defer func() {
 		_ = f.Close()
 	}()
 
-	return tail.serialize(f)
+	if _, err = f.Write(record); err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		_ = f.Truncate(s.size)
+		return fmt.Errorf("failed to write WAL Segment: %w", err)
+	}
+
+	if created {
+		if err = syncDir(w.root); err != nil {
+			return fmt.Errorf("failed to write WAL Segment: %w", err)
+		}
+	}
+
+	s.append(v)
+	s.size += int64(len(record))
+	return nil
+}
+
+// Remove removes all records matching the specified predicate from the WAL, returning the
+// number of records that were removed. Segments are read one at a time, each segment that
+// contained a matching record is committed to disk, and segments that no longer contain any
+// records are trimmed.
+func (w *WAL[T]) Remove(match func(v T) bool) (int, error) {
+	unlock, err := w.lock()
+	if err != nil {
+		return 0, fmt.Errorf("remove: %w", err)
+	}
+
+	defer unlock()
+
+	ids, err := w.list()
+	if err != nil {
+		return 0, fmt.Errorf("remove: %w", err)
+	}
+
+	var removed int
+	for _, id := range ids {
+		segment, err := w.read(id)
+		if err != nil {
+			return removed, fmt.Errorf("remove: %w", err)
+		}
+
+		if segment == nil {
+			continue
+		}
+
+		n := segment.remove(match)
+		removed += n
+
+		switch {
+		case n == 0:
+			continue
+		case segment.Length() == 0:
+			log.WithField("segment", id.String()).Trace("Segment is empty, attempting to trim")
+			if err := w.trim(id); err != nil {
+				return removed, fmt.Errorf("remove: %w", err)
+			}
+		default:
+			if err := w.commit(segment); err != nil {
+				return removed, fmt.Errorf("remove: segment %s: %w", id.String(), err)
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// RemoveLast removes the most recently appended record matching the specified predicate
+// from the WAL, returning true if a record was removed. If this was the last record in
+// its segment, the segment is trimmed.
+func (w *WAL[T]) RemoveLast(match func(v T) bool) (bool, error) {
+	unlock, err := w.lock()
+	if err != nil {
+		return false, fmt.Errorf("remove: %w", err)
+	}
+
+	defer unlock()
+
+	ids, err := w.list()
+	if err != nil {
+		return false, fmt.Errorf("remove: %w", err)
+	}
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		segment, err := w.read(ids[i])
+		if err != nil {
+			return false, fmt.Errorf("remove: %w", err)
+		}
+
+		if segment == nil || !segment.removeLast(match) {
+			continue
+		}
+
+		if segment.Length() == 0 {
+			log.WithField("segment", ids[i].String()).Trace("Segment is empty, attempting to trim")
+			if err := w.trim(ids[i]); err != nil {
+				return true, fmt.Errorf("remove: %w", err)
+			}
+		} else if err := w.commit(segment); err != nil {
+			return true, fmt.Errorf("remove: segment %s: %w", ids[i].String(), err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// DropSegment removes the segment with the specified ID from the WAL, discarding all of its records
+func (w *WAL[T]) DropSegment(id ulid.ULID) error {
+	unlock, err := w.lock()
+	if err != nil {
+		return fmt.Errorf("drop segment %s: %w", id.String(), err)
+	}
+
+	defer unlock()
+
+	return w.trim(id)
+}
+
+// DropRecord removes the record at the specified index from the segment with the specified ID, returning the removed
+// record. If this was the last record in the segment, the segment is trimmed.
+func (w *WAL[T]) DropRecord(id ulid.ULID, index int) (T, error) {
+	var result T
+
+	unlock, err := w.lock()
+	if err != nil {
+		return result, fmt.Errorf("drop record %d from segment %s: %w", index, id.String(), err)
+	}
+
+	defer unlock()
+
+	segment, err := w.read(id)
+	if err != nil {
+		return result, fmt.Errorf("drop record %d: %w", index, err)
+	}
+
+	if segment == nil {
+		return result, fmt.Errorf("drop record %d from segment %s: %w", index, id.String(), ErrNoSuchSegment)
+	}
+
+	if index < 0 || index >= segment.Length() {
+		return result, fmt.Errorf("drop record %d from segment %s: %w", index, id.String(), ErrNoSuchRecord)
+	}
+
+	result = segment.records[index]
+	if segment.Length() == 1 {
+		return result, w.trim(id)
+	}
+
+	segment.records = slices.Delete(segment.records, index, index+1)
+	if err := w.commit(segment); err != nil {
+		return result, fmt.Errorf("drop record %d from segment %s: %w", index, id.String(), err)
+	}
+
+	return result, nil
+}
+
+// trim removes the segment with the specified ID from the filesystem. The caller must hold the lock.
+func (w *WAL[T]) trim(id ulid.ULID) error {
+	err := os.Remove(filepath.Join(w.root, id.String()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("trim segment %s: %w", id.String(), ErrNoSuchSegment)
+	}
+
+	if err != nil {
+		return fmt.Errorf("trim segment %s: %w", id.String(), err)
+	}
+
+	w.removeMetadata(id)
+	return nil
+}
+
+// next reads the first segment in the WAL created after the segment with the specified ID
+// that is due to be processed, or nil if there are no more segments
+func (w *WAL[T]) next(after ulid.ULID) (*Segment[T], error) {
+	unlock, err := w.lock()
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	ids, err := w.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if id.Compare(after) <= 0 {
+			continue
+		}
+
+		segment, err := w.read(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if segment == nil {
+			continue
+		}
+
+		if !segment.meta.Due(time.Now()) {
+			log.WithField("segment", id.String()).Debugf(
+				"Skipping segment until %s after %d failed attempt(s)",
+				segment.meta.NextAttempt.Local().Format(time.DateTime), segment.meta.Attempts,
+			)
+			continue
+		}
+
+		return segment, nil
+	}
+
+	return nil, nil
 }
 
 // Process iterates through WAL segments in order and invokes the specified visitation
-// function on each segment. If the function returns no error, the segment is trimmed
-// from the WAL. If the function returns an error, processing stops and the segment is
-// retained.
-func (w *WAL[T]) Process(visit func(segment Segment[T]) error) error {
+// function on each segment. Segments are read from disk one at a time.
+//
+// If the function returns no error, it returns a Result for each record in the segment,
+// in order. Records that should be retried are rewritten to the segment and the rest
+// are removed. If every record is removed, the segment is trimmed from the WAL. If the
+// function returns nil results, every record is considered Accepted. If the function
+// returns an error, processing stops and the segment is retained as-is. The failed
+// attempt is recorded in the segment's metadata unless the error wraps ErrSkipped. If
+// the function returns results along with an error, the results are applied first, and
+// records kept for retry only count as a failed attempt if the error doesn't wrap
+// ErrSkipped.
+//
+// Only one process may process the WAL at a time. If another process is already
+// processing the WAL, an error wrapping ErrBusy is returned. Records appended while
+// the WAL is being processed are added to new segments.
+func (w *WAL[T]) Process(visit func(segment Segment[T]) ([]Result, error)) error {
+	l, err := flock.TryAcquire(filepath.Join(w.root, processLockFile))
+	if errors.Is(err, flock.ErrLocked) {
+		return fmt.Errorf("process WAL: %w", ErrBusy)
+	}
+
+	if err != nil {
+		return fmt.Errorf("process WAL: %w", err)
+	}
+
+	defer func() {
+		_ = l.Release()
+	}()
+
 	log.Debug("Processing WAL")
-	for len(w.segments) > 0 {
-		head := w.segments[0]
-		log := log.WithField("segment", head.id.String())
+
+	var last ulid.ULID
+	for {
+		segment, err := w.next(last)
+		if err != nil {
+			return fmt.Errorf("process WAL: %w", err)
+		}
+
+		if segment == nil {
+			return nil
+		}
+
+		last = segment.id
+
+		log := log.WithField("segment", segment.id.String())
 		log.Trace("Processing segment")
 
-		if err := visit(*head); err != nil {
-			return fmt.Errorf("process WAL segment %s: %w", head.id.String(), err)
+		results, err := visit(*segment)
+		if err != nil {
+			skipped := errors.Is(err, ErrSkipped)
+			if skipped {
+				log.WithError(err).Debug("Segment was skipped")
+			}
+
+			if results != nil {
+				if applyErr := w.applyResults(segment, results, !skipped); applyErr != nil {
+					log.WithError(applyErr).Warn("Failed to save partial progress")
+				}
+			} else if !skipped {
+				if failErr := w.recordFailure(segment, err.Error()); failErr != nil {
+					log.WithError(failErr).Warn("Failed to record failed attempt")
+				}
+			}
+
+			return fmt.Errorf("process WAL segment %s: %w", segment.id.String(), err)
+		}
+
+		if err = w.applyResults(segment, results, true); err != nil {
+			return fmt.Errorf("process WAL segment %s: %w", segment.id.String(), err)
+		}
+	}
+}
+
+// recordFailure takes the lock and records a failed attempt to process the specified segment
+func (w *WAL[T]) recordFailure(segment *Segment[T], reason string) error {
+	unlock, err := w.lockContext(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	return w.fail(segment, reason)
+}
+
+// applyResults checks that there is a result for each record in the specified segment
+// before applying them
+func (w *WAL[T]) applyResults(segment *Segment[T], results []Result, countFailure bool) error {
+	if results != nil && len(results) != segment.Length() {
+		return fmt.Errorf("got %d results for %d records", len(results), segment.Length())
+	}
+
+	return w.apply(segment, results, countFailure)
+}
+
+// apply keeps the records in the specified segment that should be retried, trimming the
+// segment if there are none. If any records are kept and countFailure is true, the
+// attempt counts as a failure. The records may have already been sent, so apply waits
+// for the lock even if the WAL's context is done.
+//
+// Records may have been removed from the segment while it was being processed, so the
+// segment is read again and only the records that are still in it are kept.
+func (w *WAL[T]) apply(segment *Segment[T], results []Result, countFailure bool) error {
+	unlock, err := w.lockContext(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	current, err := w.read(segment.id)
+	if err != nil && !errors.Is(err, ErrNoSuchSegment) {
+		return fmt.Errorf("failed to re-read segment: %w", err)
+	}
+
+	if current == nil {
+		log.WithField("segment", segment.id.String()).Trace("Segment was removed while it was being processed")
+		return nil
+	}
+
+	retry, reason, err := retained(segment.records, results, current.records)
+	if err != nil {
+		return fmt.Errorf("failed to match records: %w", err)
+	}
+
+	if len(retry) == 0 {
+		log.WithField("segment", segment.id.String()).Trace("Successfully Processed segment, attempting to trim")
+
+		err = w.trim(segment.id)
+		if err != nil && !errors.Is(err, ErrNoSuchSegment) {
+			return fmt.Errorf("failed to trim segment: %w", err)
 		}
 
-		log.Trace("Successfully Processed segment, attempting  to trim")
+		return nil
+	}
 
-		// Remove the segment from the filesystem
-		if err := os.Remove(filepath.Join(w.root, head.id.String())); err != nil {
-			return fmt.Errorf("process WAL segment %s: failed to trim segment: %w", head.id.String(), err)
+	if len(retry) < current.Length() {
+		log.WithField("segment", segment.id.String()).Tracef("Keeping %d record(s) to retry", len(retry))
+		current.records = retry
+		if err = w.commit(current); err != nil {
+			return fmt.Errorf("failed to rewrite segment: %w", err)
 		}
+	}
 
-		// Remove the segment from the list
-		w.segments = w.segments[1:]
+	if !countFailure {
+		return nil
 	}
 
-	return nil
+	return w.fail(current, reason)
+}
+
+// retained returns the records in current that should be retried, and the reason the
+// first of them should be. processed are the records results were computed for, and
+// current are the records in the segment now, which are the same records with any that
+// were removed in the meantime left out. Records in current that can't be matched to a
+// processed record are kept.
+func retained[T any](processed []T, results []Result, current []T) ([]T, string, error) {
+	var retry []T
+	var reason string
+
+	i := 0
+	for _, v := range current {
+		want, err := encodeRecord(v)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for ; i < len(processed); i++ {
+			got, err := encodeRecord(processed[i])
+			if err != nil {
+				return nil, "", err
+			}
+
+			if bytes.Equal(want, got) {
+				break
+			}
+		}
+
+		if i == len(processed) {
+			retry = append(retry, v)
+			continue
+		}
+
+		if results != nil && results[i].Outcome == Retry {
+			retry = append(retry, v)
+			if reason == "" {
+				reason = results[i].Reason
+			}
+		}
+
+		i++
+	}
+
+	return retry, reason, nil
 }
@@ -1,14 +1,18 @@
 package wal
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/oklog/ulid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/nlowe/pianoman/internal/flock"
 	"github.com/nlowe/pianoman/lastfm"
 )
 
@@ -27,18 +31,18 @@ func TestWAL(t *testing.T) {
 		require.NoError(t, sut.Append(i))
 	}
 
-	require.Len(t, sut.segments, 2)
+	require.Len(t, segments(t, sut), 2)
 
 	// Re-Open the WAL to exercise segment loading
 	sut, err = Open[int](root, lastfm.MaxTracksPerScrobble)
 	require.NoError(t, err)
-	require.Len(t, sut.segments, 2)
+	require.Len(t, segments(t, sut), 2)
 
 	// Process the first segment and stop
 	var notFirst bool
-	require.ErrorContains(t, sut.Process(func(segment Segment[int]) error {
+	require.ErrorContains(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
 		if notFirst {
-			return fmt.Errorf("dummy")
+			return nil, fmt.Errorf("dummy")
 		}
 
 		notFirst = true
@@ -50,18 +54,18 @@ func TestWAL(t *testing.T) {
 			assert.Equalf(t, i, records[i], "element at position %d does not have expected value: got %d", i, records[i])
 		}
 
-		return nil
+		return nil, nil
 	}), "dummy")
 
 	// We should have one segment left
-	require.Len(t, sut.segments, 1)
+	require.Len(t, segments(t, sut), 1)
 
 	// Re-Open the WAL again to verify a single segment
 	sut, err = Open[int](root, lastfm.MaxTracksPerScrobble)
 	require.NoError(t, err)
-	require.Len(t, sut.segments, 1)
+	require.Len(t, segments(t, sut), 1)
 
-	require.NoError(t, sut.Process(func(segment Segment[int]) error {
+	require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
 		records := segment.Records()
 		require.Len(t, records, 25)
 
@@ -69,11 +73,476 @@ func TestWAL(t *testing.T) {
 			assert.Equalf(t, lastfm.MaxTracksPerScrobble+i, records[i], "element at position %d does not have expected value: got %d", i, records[i])
 		}
 
-		return nil
+		return nil, nil
 	}))
 
 	// Re-Open the WAL one last time to verify no segments remain
 	sut, err = Open[int](root, lastfm.MaxTracksPerScrobble)
 	require.NoError(t, err)
-	require.Empty(t, sut.segments)
+	require.Empty(t, segments(t, sut))
+}
+
+func TestWAL_Remove(t *testing.T) {
+	root := t.TempDir()
+
+	sut, err := Open[int](root, 5)
+	require.NoError(t, err)
+
+	for _, v := range []int{0, 1, 2, 3, 4, 0, 1, 0, 1, 0, 5, 6} {
+		require.NoError(t, sut.Append(v))
+	}
+
+	require.Len(t, segments(t, sut), 3)
+
+	// Remove every record from the middle segment and some records from the first
+	removed, err := sut.Remove(func(v int) bool {
+		return v < 2
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 7, removed)
+
+	// Re-Open the WAL to verify the changes were committed
+	sut, err = Open[int](root, 5)
+	require.NoError(t, err)
+	require.Len(t, segments(t, sut), 2)
+
+	assert.Equal(t, []int{2, 3, 4}, segments(t, sut)[0].Records())
+	assert.Equal(t, []int{5, 6}, segments(t, sut)[1].Records())
+}
+
+func TestWAL_RemoveLast(t *testing.T) {
+	root := t.TempDir()
+
+	sut, err := Open[int](root, 2)
+	require.NoError(t, err)
+
+	for _, v := range []int{0, 1, 1, 2, 0} {
+		require.NoError(t, sut.Append(v))
+	}
+
+	require.Len(t, segments(t, sut), 3)
+
+	isOne := func(v int) bool {
+		return v == 1
+	}
+
+	// Only the most recent matching record should be removed
+	removed, err := sut.RemoveLast(isOne)
+	require.NoError(t, err)
+	assert.True(t, removed)
+
+	// Removing the last record in a segment should trim it
+	removed, err = sut.RemoveLast(func(v int) bool {
+		return v == 2
+	})
+	require.NoError(t, err)
+	assert.True(t, removed)
+
+	removed, err = sut.RemoveLast(func(v int) bool {
+		return v == 3
+	})
+	require.NoError(t, err)
+	assert.False(t, removed)
+
+	// Re-Open the WAL to verify the changes were committed
+	sut, err = Open[int](root, 2)
+	require.NoError(t, err)
+	require.Len(t, segments(t, sut), 2)
+
+	assert.Equal(t, []int{0, 1}, segments(t, sut)[0].Records())
+	assert.Equal(t, []int{0}, segments(t, sut)[1].Records())
+}
+
+func TestWAL_Segments(t *testing.T) {
+	sut, err := Open[int](t.TempDir(), 2)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sut.Append(i))
+	}
+
+	result := segments(t, sut)
+	require.Len(t, result, 2)
+
+	assert.FileExists(t, filepath.Join(sut.root, result[0].ID().String()))
+	assert.WithinDuration(t, time.Now(), result[0].CreatedAt(), time.Minute)
+	assert.Equal(t, []int{0, 1}, result[0].Records())
+	assert.Equal(t, []int{2}, result[1].Records())
+
+	// Modifying the returned segments should not modify the WAL
+	result[0].append(3)
+	assert.Equal(t, 2, segments(t, sut)[0].Length())
+}
+
+func TestWAL_Drop(t *testing.T) {
+	root := t.TempDir()
+
+	sut, err := Open[int](root, 2)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sut.Append(i))
+	}
+
+	require.Len(t, segments(t, sut), 3)
+	first, second, third := segments(t, sut)[0].id, segments(t, sut)[1].id, segments(t, sut)[2].id
+
+	t.Run("Segment", func(t *testing.T) {
+		require.NoError(t, sut.DropSegment(first))
+		require.ErrorIs(t, sut.DropSegment(first), ErrNoSuchSegment)
+	})
+
+	t.Run("Record", func(t *testing.T) {
+		v, err := sut.DropRecord(second, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 2, v)
+
+		_, err = sut.DropRecord(second, 1)
+		require.ErrorIs(t, err, ErrNoSuchRecord)
+
+		// Dropping the last record in a segment should trim it
+		v, err = sut.DropRecord(third, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 4, v)
+	})
+
+	// Re-Open the WAL to verify the changes were committed
+	sut, err = Open[int](root, 2)
+	require.NoError(t, err)
+	require.Len(t, segments(t, sut), 1)
+	assert.Equal(t, second, segments(t, sut)[0].id)
+	assert.Equal(t, []int{3}, segments(t, sut)[0].Records())
+}
+
+func TestWAL_Locking(t *testing.T) {
+	t.Run("Busy", func(t *testing.T) {
+		root := t.TempDir()
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+		require.NoError(t, sut.Append(1))
+
+		other, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+
+		var visited []int
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			visited = append(visited, segment.Records()...)
+			if len(visited) > 1 {
+				return nil, nil
+			}
+
+			// Processing the WAL from somewhere else should fail while we're processing it
+			require.ErrorIs(t, other.Process(func(segment Segment[int]) ([]Result, error) {
+				t.Error("segment should not have been processed twice")
+				return nil, nil
+			}), ErrBusy)
+
+			// Appending while the WAL is being processed should cut a new segment
+			require.NoError(t, other.Append(2))
+			require.Len(t, segments(t, other), 2)
+
+			return nil, nil
+		}))
+
+		// The segment appended while processing should have been processed as well
+		assert.Equal(t, []int{1, 2}, visited)
+
+		sut, err = Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+		require.Empty(t, segments(t, sut))
+	})
+
+	t.Run("Removed While Processing", func(t *testing.T) {
+		root := t.TempDir()
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+		for i := 1; i <= 4; i++ {
+			require.NoError(t, sut.Append(i))
+		}
+
+		other, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			// Records removed from somewhere else while we're processing the segment should stay removed
+			removed, err := other.Remove(func(v int) bool {
+				return v == 2 || v == 3
+			})
+			require.NoError(t, err)
+			require.Equal(t, 2, removed)
+
+			return []Result{{Outcome: Accepted}, {Outcome: Retry}, {Outcome: Accepted}, {Outcome: Retry}}, nil
+		}))
+
+		require.Len(t, segments(t, sut), 1)
+		assert.Equal(t, []int{4}, segments(t, sut)[0].Records())
+	})
+
+	t.Run("Dropped While Processing", func(t *testing.T) {
+		root := t.TempDir()
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+		require.NoError(t, sut.Append(1))
+		require.NoError(t, sut.Append(2))
+
+		other, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			require.NoError(t, other.DropSegment(segment.ID()))
+			return []Result{{Outcome: Retry}, {Outcome: Retry}}, nil
+		}))
+
+		assert.Empty(t, segments(t, sut))
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		root := t.TempDir()
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble, WithLockTimeout(10*time.Millisecond))
+		require.NoError(t, err)
+
+		unlock, err := sut.lock()
+		require.NoError(t, err)
+		defer unlock()
+
+		require.ErrorIs(t, sut.Append(1), flock.ErrLocked)
+	})
+
+	t.Run("Context Done", func(t *testing.T) {
+		root := t.TempDir()
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble, WithLockTimeout(time.Minute))
+		require.NoError(t, err)
+
+		unlock, err := sut.lock()
+		require.NoError(t, err)
+		defer unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		require.ErrorIs(t, sut.WithContext(ctx).Append(1), context.DeadlineExceeded)
+	})
+
+	t.Run("Sees Changes From Other Processes", func(t *testing.T) {
+		root := t.TempDir()
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+
+		other, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+
+		require.NoError(t, sut.Append(1))
+		require.NoError(t, other.Append(2))
+
+		var records []int
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			records = append(records, segment.Records()...)
+			return nil, nil
+		}))
+
+		assert.Equal(t, []int{1, 2}, records)
+	})
+}
+
+func TestWAL_Quarantine(t *testing.T) {
+	root := t.TempDir()
+
+	sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+	require.NoError(t, err)
+	require.NoError(t, sut.Append(1))
+
+	corrupt := ulid.MustNew(ulid.Now()+1, ulidEntropySource).String()
+	require.NoError(t, os.WriteFile(filepath.Join(root, corrupt), []byte(`{"checksum":"00000000","records":[2]}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, corrupt+metadataSuffix), []byte(`{"attempts":1}`), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "."+corrupt+tempFileSuffix), []byte(`[3`), 0600))
+
+	sut, err = Open[int](root, lastfm.MaxTracksPerScrobble)
+	require.NoError(t, err)
+
+	// Listing segments reports the corrupt segment without moving it
+	result := segments(t, sut)
+	require.Len(t, result, 1)
+	assert.Equal(t, []int{1}, result[0].Records())
+	assert.FileExists(t, filepath.Join(root, corrupt))
+
+	var visited [][]int
+	require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+		visited = append(visited, segment.Records())
+		return []Result{{Outcome: Retry}}, nil
+	}))
+
+	assert.Equal(t, [][]int{{1}}, visited)
+	assert.FileExists(t, filepath.Join(root, quarantineDirectory, corrupt))
+	assert.FileExists(t, filepath.Join(root, quarantineDirectory, corrupt+metadataSuffix))
+	assert.NoFileExists(t, filepath.Join(root, corrupt))
+	assert.NoFileExists(t, filepath.Join(root, corrupt+metadataSuffix))
+	assert.NoFileExists(t, filepath.Join(root, "."+corrupt+tempFileSuffix))
+}
+
+func TestWAL_Segments_ReadOnly(t *testing.T) {
+	root := t.TempDir()
+
+	files := map[string]string{}
+	for i, contents := range []string{
+		// Legacy
+		"[1,2]\n",
+		// Torn record
+		"90f599e3 1\n83a56a17 2\n71ce",
+		// Empty
+		"",
+		// Corrupt
+		"definitely not json\n",
+	} {
+		id := ulid.MustNew(ulid.Now()+uint64(i), ulidEntropySource).String()
+		require.NoError(t, os.WriteFile(filepath.Join(root, id), []byte(contents), 0600))
+		files[id] = contents
+	}
+
+	sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+	require.NoError(t, err)
+
+	result := segments(t, sut)
+	require.Len(t, result, 2)
+	assert.Equal(t, []int{1, 2}, result[0].Records())
+	assert.Equal(t, []int{1, 2}, result[1].Records())
+
+	for id, want := range files {
+		contents, err := os.ReadFile(filepath.Join(root, id))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(contents))
+	}
+
+	assert.NoDirExists(t, filepath.Join(root, quarantineDirectory))
+}
+
+func TestWAL_Format(t *testing.T) {
+	t.Run("Migrates Legacy Segments", func(t *testing.T) {
+		root := t.TempDir()
+
+		id := ulid.MustNew(ulid.Now(), ulidEntropySource).String()
+		require.NoError(t, os.WriteFile(filepath.Join(root, id), []byte("[1,2,3]\n"), 0600))
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+		require.NoError(t, sut.Append(4))
+
+		contents, err := os.ReadFile(filepath.Join(root, id))
+		require.NoError(t, err)
+		assert.Equal(t, "90f599e3 1\n83a56a17 2\n71cee914 3\na5048dff 4\n", string(contents))
+	})
+
+	t.Run("Truncates Torn Records", func(t *testing.T) {
+		root := t.TempDir()
+
+		id := ulid.MustNew(ulid.Now(), ulidEntropySource).String()
+		require.NoError(t, os.WriteFile(filepath.Join(root, id), []byte("90f599e3 1\n83a56a17 2\n71ce"), 0600))
+
+		sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+		require.NoError(t, err)
+		require.NoError(t, sut.Append(3))
+
+		contents, err := os.ReadFile(filepath.Join(root, id))
+		require.NoError(t, err)
+		assert.Equal(t, "90f599e3 1\n83a56a17 2\n71cee914 3\n", string(contents))
+	})
+}
+
+func segments[T any](t *testing.T, w *WAL[T]) []Segment[T] {
+	t.Helper()
+
+	result, err := w.Segments()
+	require.NoError(t, err)
+
+	return result
+}
+
+func TestWAL_Lazy(t *testing.T) {
+	root := t.TempDir()
+
+	head := ulid.MustNew(ulid.Now(), ulidEntropySource).String()
+	require.NoError(t, os.WriteFile(filepath.Join(root, head), []byte("definitely not json\n"), 0600))
+
+	tail := ulid.MustNew(ulid.Now()+1, ulidEntropySource).String()
+	require.NoError(t, os.WriteFile(filepath.Join(root, tail), []byte("90f599e3 1\n"), 0600))
+
+	sut, err := Open[int](root, lastfm.MaxTracksPerScrobble)
+	require.NoError(t, err)
+	require.NoError(t, sut.Append(2))
+
+	// Only the tail should have been read
+	assert.FileExists(t, filepath.Join(root, head))
+
+	var visited [][]int
+	require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+		visited = append(visited, segment.Records())
+		return nil, nil
+	}))
+
+	assert.Equal(t, [][]int{{1, 2}}, visited)
+	assert.FileExists(t, filepath.Join(root, quarantineDirectory, head))
+}
+
+func TestWAL_Results(t *testing.T) {
+	sut, err := Open[int](t.TempDir(), lastfm.MaxTracksPerScrobble)
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, sut.Append(i))
+	}
+
+	t.Run("Mismatched", func(t *testing.T) {
+		require.ErrorContains(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			return []Result{{Outcome: Accepted}}, nil
+		}), "got 1 results for 5 records")
+
+		assert.Equal(t, []int{1, 2, 3, 4, 5}, segments(t, sut)[0].Records())
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		var visits int
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			visits++
+			return []Result{
+				{Outcome: Accepted},
+				{Outcome: Ignored, Reason: "dummy"},
+				{Outcome: Retry},
+				{Outcome: Accepted},
+				{Outcome: Retry},
+			}, nil
+		}))
+
+		// Retried records should not be visited again in the same pass
+		assert.Equal(t, 1, visits)
+
+		result := segments(t, sut)
+		require.Len(t, result, 1)
+		assert.Equal(t, []int{3, 5}, result[0].Records())
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		require.NoError(t, sut.ResetBackoff())
+		require.ErrorContains(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			return []Result{{Outcome: Accepted}, {Outcome: Retry}}, fmt.Errorf("dummy")
+		}), "dummy")
+
+		// The results should be applied, and the records kept for retry should back off
+		result := segments(t, sut)
+		require.Len(t, result, 1)
+		assert.Equal(t, []int{5}, result[0].Records())
+		assert.Equal(t, 1, result[0].Metadata().Attempts)
+	})
+
+	t.Run("Accepted", func(t *testing.T) {
+		require.NoError(t, sut.Process(func(segment Segment[int]) ([]Result, error) {
+			return []Result{{Outcome: Accepted}}, nil
+		}))
+
+		assert.True(t, sut.Empty())
+	})
 }